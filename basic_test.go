@@ -1,7 +1,11 @@
 package serial
 
 import (
+	"bytes"
+	"log"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConnection(t *testing.T) {
@@ -65,3 +69,159 @@ func TestConnection(t *testing.T) {
 	// 	t.Fatalf("Expected less than %v read, got %v", exp, c)
 	// }
 }
+
+func TestLogUTF8(t *testing.T) {
+	var out bytes.Buffer
+	p := BasePort{logger: log.New(&out, "", 0), charset: UTF8}
+
+	data := []byte("Привет, GPS°\xff!")
+	// split a multi-byte sequence across two flushes
+	p.logData('+', data[:3])
+	p.logFlush()
+	p.logData('+', data[3:])
+	p.logFlush()
+
+	s := out.String()
+	for _, want := range []string{"П\n", "ривет, GPS°\n", " .!\n"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("log %q does not contain %q", s, want)
+		}
+	}
+}
+
+func TestLogOffsets(t *testing.T) {
+	var out bytes.Buffer
+	p := BasePort{logger: log.New(&out, "", 0), cfg: Config{LogOffsets: true}}
+
+	p.logData('+', bytes.Repeat([]byte{'a'}, 20))
+	p.logData('-', []byte("tx"))
+	p.logData('+', []byte("b"))
+	p.logFlush()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for i, want := range []string{"+ +0x0000: 61 ", "+ +0x0010: 61 ", "- +0x0000: 74 ", "+ +0x0014: 62 "} {
+		if i >= len(lines) || !strings.HasPrefix(lines[i], want) {
+			t.Fatalf("log %q, line %d does not start with %q", out.String(), i, want)
+		}
+	}
+}
+
+func TestCharsetDecode(t *testing.T) {
+	tests := []struct {
+		cs   LogCharset
+		data []byte
+		want string
+	}{
+		{KOI8R, []byte{0xF0, 0xD2, 0xC9, 0xD7, 0xC5, 0xD4, '!'}, "Привет!"},
+		{CP866, []byte{0x8F, 0xE0, 0xA8, 0xA2, 0xA5, 0xE2, '!'}, "Привет!"},
+	}
+	for _, tt := range tests {
+		var got []rune
+		for _, b := range tt.data {
+			got = append(got, tt.cs.decode(b))
+		}
+		if string(got) != tt.want {
+			t.Errorf("charset %d: got %q, want %q", tt.cs, string(got), tt.want)
+		}
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	tests := []struct {
+		c    Config
+		want string
+	}{
+		{Config{Name: "COM3", Baud: 115200, ReadTimeout: 500 * time.Millisecond}, "COM3 115200 8N1 rt=500ms"},
+		{Config{Name: "/dev/ttyS0", Baud: 9600, StopBits: StopBits2}, "/dev/ttyS0 9600 8N2"},
+		{Config{Name: "COM1", Baud: 300, StopBits: StopBits1Half, NonBlocking: true}, "COM1 300 8N1.5 nonblock"},
+		{Config{Name: "COM2", Baud: 1200, DataBits: 7, Parity: ParityEven, StopBits: StopBits1}, "COM2 1200 7E1"},
+		{Config{Name: "COM4", Baud: 9600, FlowControl: FlowRTSCTS}, "COM4 9600 8N1 rtscts"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestStandardBauds(t *testing.T) {
+	bauds := StandardBauds()
+	if len(bauds) == 0 {
+		t.Fatal("no standard bauds")
+	}
+	found := false
+	for i, b := range bauds {
+		if i > 0 && b <= bauds[i-1] {
+			t.Fatalf("StandardBauds not ascending: %v", bauds)
+		}
+		found = found || b == Baud9600
+	}
+	if !found {
+		t.Fatalf("StandardBauds lacks 9600: %v", bauds)
+	}
+}
+
+func TestCharTime(t *testing.T) {
+	tests := []struct {
+		c    Config
+		want time.Duration
+	}{
+		{Config{Baud: 9600}, 10 * time.Second / 9600},
+		{Config{Baud: 9600, DataBits: 7, Parity: ParityEven, StopBits: StopBits2}, 11 * time.Second / 9600},
+		{Config{Baud: 50, DataBits: 5, StopBits: StopBits1Half}, 150 * time.Millisecond},
+		{Config{}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.c.CharTime(); got != tt.want {
+			t.Errorf("%v: CharTime() = %v, want %v", tt.c, got, tt.want)
+		}
+	}
+	c := Config{Baud: 19200}
+	if got, want := c.FrameSilence(3.5), 35*time.Second/19200; got < want-time.Nanosecond || got > want+time.Nanosecond {
+		t.Errorf("FrameSilence(3.5) = %v, want %v", got, want)
+	}
+}
+
+func TestLogControl(t *testing.T) {
+	var out bytes.Buffer
+	p := BasePort{logger: log.New(&out, "", 0)}
+
+	l := Lines{CTS: true, DTR: true}
+	p.logControl("Lines", l.String())
+	if got, want := out.String(), "[Lines] CTS+ DSR- RI- DCD- DTR+ RTS-\n"; got != want {
+		t.Fatalf("log = %q, want %q", got, want)
+	}
+	out.Reset()
+	p.cfg.NoLogControl = true
+	p.logControl("DTR", "%t", false)
+	if out.Len() != 0 {
+		t.Fatalf("log = %q with NoLogControl", out.String())
+	}
+}
+
+func TestPollPorts(t *testing.T) {
+	lists := make(chan []string, 3)
+	lists <- []string{"COM1"}
+	lists <- []string{"COM1", "COM3"}
+	lists <- []string{"COM3"}
+	events, stop := pollPorts(func() []string {
+		select {
+		case l := <-lists:
+			return l
+		default:
+			return []string{"COM3"}
+		}
+	}, time.Millisecond)
+	defer stop()
+
+	for _, want := range []PortEvent{{"COM3", true}, {"COM1", false}} {
+		select {
+		case ev := <-events:
+			if ev != want {
+				t.Fatalf("event %+v; want %+v", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %+v", want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package serial
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/istperm/utils"
+	//"main/utils"
+)
+
+// LogCharset selects how the log text column decodes port data
+type LogCharset int
+
+const (
+	// CP1251 decodes each byte as a single character (default)
+	CP1251 LogCharset = iota
+	// UTF8 decodes multi-byte UTF-8 sequences, invalid bytes are shown as '.'
+	UTF8
+	// KOI8R decodes bytes as KOI8-R
+	KOI8R
+	// CP866 decodes bytes as DOS Cyrillic
+	CP866
+)
+
+// ByteDecoder maps a byte of port data to a character of the log text column
+type ByteDecoder func(byte) rune
+
+// AsciiToUnicode is the default ByteDecoder, it decodes CP1251
+func AsciiToUnicode(b byte) rune {
+	return utils.CharToRune(b)
+}
+
+// logChar appends the text column representation of b.
+// In UTF8 mode incomplete sequences are kept across flushes.
+func (p *BasePort) logChar(asc *strings.Builder, b byte) {
+	if p.decoder != nil {
+		// custom decoders see all bytes, control codes may be printable
+		r := p.decoder(b)
+		if !unicode.IsPrint(r) {
+			r = '.'
+		}
+		asc.WriteRune(r)
+		return
+	}
+	if p.charset != UTF8 {
+		r := '.'
+		if b >= 0x20 {
+			r = p.charset.decode(b)
+		}
+		asc.WriteRune(r)
+		return
+	}
+
+	if p.utfLen > 0 {
+		if b&0xC0 == 0x80 {
+			p.utfBuf[p.utfLen] = b
+			p.utfLen++
+			if !utf8.FullRune(p.utfBuf[:p.utfLen]) {
+				return
+			}
+			r, n := utf8.DecodeRune(p.utfBuf[:p.utfLen])
+			if r == utf8.RuneError || n != p.utfLen || !unicode.IsPrint(r) {
+				asc.WriteString(strings.Repeat(".", p.utfLen))
+			} else {
+				asc.WriteRune(r)
+			}
+			p.utfLen = 0
+			return
+		}
+		// sequence broken by a non-continuation byte
+		asc.WriteString(strings.Repeat(".", p.utfLen))
+		p.utfLen = 0
+	}
+
+	switch {
+	case b < utf8.RuneSelf:
+		r := rune(b)
+		if !unicode.IsPrint(r) {
+			r = '.'
+		}
+		asc.WriteRune(r)
+	case b >= 0xC2 && b <= 0xF4:
+		p.utfBuf[0] = b
+		p.utfLen = 1
+	default:
+		asc.WriteByte('.')
+	}
+}
+
+// decode maps a byte of a single byte charset to unicode
+func (cs LogCharset) decode(b byte) rune {
+	var high *[128]rune
+	switch cs {
+	case KOI8R:
+		high = &koi8r
+	case CP866:
+		high = &cp866
+	default:
+		return AsciiToUnicode(b)
+	}
+	if b < 0x80 {
+		return rune(b)
+	}
+	return high[b-0x80]
+}
+
+// koi8r and cp866 hold the high halves (0x80..0xFF) of the charsets
+var koi8r = [128]rune{
+	0x2500, 0x2502, 0x250C, 0x2510, 0x2514, 0x2518, 0x251C, 0x2524,
+	0x252C, 0x2534, 0x253C, 0x2580, 0x2584, 0x2588, 0x258C, 0x2590,
+	0x2591, 0x2592, 0x2593, 0x2320, 0x25A0, 0x2219, 0x221A, 0x2248,
+	0x2264, 0x2265, 0x00A0, 0x2321, 0x00B0, 0x00B2, 0x00B7, 0x00F7,
+	0x2550, 0x2551, 0x2552, 0x0451, 0x2553, 0x2554, 0x2555, 0x2556,
+	0x2557, 0x2558, 0x2559, 0x255A, 0x255B, 0x255C, 0x255D, 0x255E,
+	0x255F, 0x2560, 0x2561, 0x0401, 0x2562, 0x2563, 0x2564, 0x2565,
+	0x2566, 0x2567, 0x2568, 0x2569, 0x256A, 0x256B, 0x256C, 0x00A9,
+	0x044E, 0x0430, 0x0431, 0x0446, 0x0434, 0x0435, 0x0444, 0x0433,
+	0x0445, 0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E,
+	0x043F, 0x044F, 0x0440, 0x0441, 0x0442, 0x0443, 0x0436, 0x0432,
+	0x044C, 0x044B, 0x0437, 0x0448, 0x044D, 0x0449, 0x0447, 0x044A,
+	0x042E, 0x0410, 0x0411, 0x0426, 0x0414, 0x0415, 0x0424, 0x0413,
+	0x0425, 0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E,
+	0x041F, 0x042F, 0x0420, 0x0421, 0x0422, 0x0423, 0x0416, 0x0412,
+	0x042C, 0x042B, 0x0417, 0x0428, 0x042D, 0x0429, 0x0427, 0x042A,
+}
+
+var cp866 = [128]rune{
+	0x0410, 0x0411, 0x0412, 0x0413, 0x0414, 0x0415, 0x0416, 0x0417,
+	0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E, 0x041F,
+	0x0420, 0x0421, 0x0422, 0x0423, 0x0424, 0x0425, 0x0426, 0x0427,
+	0x0428, 0x0429, 0x042A, 0x042B, 0x042C, 0x042D, 0x042E, 0x042F,
+	0x0430, 0x0431, 0x0432, 0x0433, 0x0434, 0x0435, 0x0436, 0x0437,
+	0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E, 0x043F,
+	0x2591, 0x2592, 0x2593, 0x2502, 0x2524, 0x2561, 0x2562, 0x2556,
+	0x2555, 0x2563, 0x2551, 0x2557, 0x255D, 0x255C, 0x255B, 0x2510,
+	0x2514, 0x2534, 0x252C, 0x251C, 0x2500, 0x253C, 0x255E, 0x255F,
+	0x255A, 0x2554, 0x2569, 0x2566, 0x2560, 0x2550, 0x256C, 0x2567,
+	0x2568, 0x2564, 0x2565, 0x2559, 0x2558, 0x2552, 0x2553, 0x256B,
+	0x256A, 0x2518, 0x250C, 0x2588, 0x2584, 0x258C, 0x2590, 0x2580,
+	0x0440, 0x0441, 0x0442, 0x0443, 0x0444, 0x0445, 0x0446, 0x0447,
+	0x0448, 0x0449, 0x044A, 0x044B, 0x044C, 0x044D, 0x044E, 0x044F,
+	0x0401, 0x0451, 0x0404, 0x0454, 0x0407, 0x0457, 0x040E, 0x045E,
+	0x00B0, 0x2219, 0x00B7, 0x221A, 0x2116, 0x00A4, 0x25A0, 0x00A0,
+}
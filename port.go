@@ -0,0 +1,954 @@
+package serial
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+var _ SerialPort = (*Port)(nil)
+
+// WaitForData waits up to timeout for received data, independently of
+// the configured ReadTimeout. It returns true if data is ready to read,
+// false on timeout. A negative timeout waits forever.
+func (p *Port) WaitForData(timeout time.Duration) (bool, error) {
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	ready, err := p.waitForData(timeout)
+	return ready, p.wrapErr("WaitForData", err)
+}
+
+// waitForData is WaitForData with rl held
+func (p *Port) waitForData(timeout time.Duration) (bool, error) {
+	if p.pendingReady() {
+		return true, nil
+	}
+	return p.poll(timeout)
+}
+
+// Close closes the port, deasserting DTR and RTS first if configured
+func (p *Port) Close() error {
+	// failures are logged, the port is closed anyway
+	if p.cfg.DrainOnClose {
+		p.Drain()
+	}
+	if p.cfg.FlushOnClose {
+		p.Purge()
+	}
+	if p.cfg.DropDTROnClose {
+		p.SetDtr(false)
+	}
+	if p.cfg.DropRTSOnClose {
+		p.SetRts(false)
+	}
+	p.wakeReader()
+	return p.wrapErr("Close", p.BasePort.Close())
+}
+
+// Err returns the first error, other than a timeout or a break, that a
+// read or write got since the port was opened, like bufio.Scanner.Err,
+// e.g. to check a batch of writes once at the end. It stays set. Like
+// the error returned then it goes through WrapError, as "Read" or "Write".
+func (p *Port) Err() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.wrapErr(p.stickyOp, p.stickyErr)
+}
+
+// IsOpen reports whether the port hasn't been closed yet
+func (p *Port) IsOpen() bool {
+	return !p.closed.Load()
+}
+
+// Probe returns the modem lines and the number of bytes available in one
+// call, e.g. for monitoring. If a query fails the others are still
+// done, the errors are joined into Error and returned. As it is called
+// often, it logs the lines only when they changed since the last Probe.
+func (p *Port) Probe() (LinkStatus, error) {
+	var s LinkStatus
+	if s.Open = p.IsOpen(); !s.Open {
+		s.Error = p.wrapErr("Probe", os.ErrClosed)
+		return s, s.Error
+	}
+	l, lerr := p.lines()
+	p.probeMu.Lock()
+	defer p.probeMu.Unlock()
+	if lerr != nil {
+		p.logMsg("Probe", "Error %s", lerr)
+	} else if !p.probed || l != p.probeLines {
+		p.logControl("Probe", l.String())
+		p.probed, p.probeLines = true, l
+	}
+	s.CTS, s.DSR, s.DCD = l.CTS, l.DSR, l.DCD
+	n, aerr := p.available()
+	s.BytesAvailable = n
+	s.Error = p.wrapErr("Probe", errors.Join(lerr, aerr))
+	return s, s.Error
+}
+
+// ApplyConfig changes the settings of the open port to those of c.
+// Name, the log and capture settings, UseDeadlines, KeepNonBlock,
+// InheritFD and RxFIFOTrigger only apply when opening and are kept.
+// Reads and writes are blocked while the port is reconfigured, and it
+// waits for a pending Read to return.
+func (p *Port) ApplyConfig(c *Config) (err error) {
+	defer func() { err = p.wrapErr("ApplyConfig", err) }()
+	return p.reconfigure(func(n *Config) {
+		old := *n
+		*n = *c
+		n.Name = old.Name
+		n.LogFile = old.LogFile
+		n.LogCharset = old.LogCharset
+		n.LogDecoder = old.LogDecoder
+		n.RawCaptureFile = old.RawCaptureFile
+		n.RawCaptureTxFile = old.RawCaptureTxFile
+		n.UseDeadlines = old.UseDeadlines
+		n.KeepNonBlock = old.KeepNonBlock
+		n.InheritFD = old.InheritFD
+		n.RxFIFOTrigger = old.RxFIFOTrigger
+	})
+}
+
+// SetBaud changes the baud rate of the open port, see ApplyConfig
+func (p *Port) SetBaud(baud int) error {
+	return p.wrapErr("SetBaud", p.reconfigure(func(c *Config) { c.Baud = baud }))
+}
+
+// SetBaudDrain changes the baud rate like SetBaud, but first waits until
+// the data already written is transmitted at the old rate, e.g. a
+// command to switch the device to the new rate. Received data is kept,
+// use FlushWith(FlushRx) to discard what came in at the old rate.
+func (p *Port) SetBaudDrain(baud int) (err error) {
+	defer func() { err = p.wrapErr("SetBaudDrain", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	if err := p.drain(); err != nil {
+		return err
+	}
+	return p.reconfigureLocked(func(c *Config) { c.Baud = baud })
+}
+
+// WithBaud runs fn at baud, e.g. the fast block transfer of a bootloader,
+// and then restores the current rate, also if fn fails. Both changes
+// drain the output first, see SetBaudDrain. The error of fn is returned
+// before one of restoring the rate.
+func (p *Port) WithBaud(baud int, fn func() error) (err error) {
+	p.rl.Lock()
+	old := p.cfg.Baud
+	p.rl.Unlock()
+
+	if err = p.SetBaudDrain(baud); err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := p.SetBaudDrain(old); err == nil {
+			err = rerr
+		}
+	}()
+	return fn()
+}
+
+// SetReadTimeout changes the ReadTimeout of the open port, see ApplyConfig
+func (p *Port) SetReadTimeout(timeout time.Duration) error {
+	return p.wrapErr("SetReadTimeout", p.reconfigure(func(c *Config) { c.ReadTimeout = timeout }))
+}
+
+// SetBlocking switches the open port to reads that wait for at least one
+// byte however long it takes, e.g. for a handshake, and back to the
+// ReadTimeout, NonBlocking and MinBytes it had before. Changes to them
+// while blocking are lost when switching back.
+func (p *Port) SetBlocking(blocking bool) (err error) {
+	defer func() { err = p.wrapErr("SetBlocking", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	if blocking == (p.unblocked != nil) {
+		return nil
+	}
+	if blocking {
+		m := readMode{p.cfg.ReadTimeout, p.cfg.NonBlocking, p.cfg.MinBytes}
+		err = p.reconfigureLocked(func(c *Config) {
+			c.ReadTimeout, c.NonBlocking, c.MinBytes = 0, false, 0
+		})
+		if err == nil {
+			p.unblocked = &m
+		}
+		return err
+	}
+	m := *p.unblocked
+	err = p.reconfigureLocked(func(c *Config) {
+		c.ReadTimeout, c.NonBlocking, c.MinBytes = m.ReadTimeout, m.NonBlocking, m.MinBytes
+	})
+	if err == nil {
+		p.unblocked = nil
+	}
+	return err
+}
+
+// SetFlowControl changes the flow control of the open port, see ApplyConfig
+func (p *Port) SetFlowControl(fc FlowControl) error {
+	return p.wrapErr("SetFlowControl", p.reconfigure(func(c *Config) { c.FlowControl = fc }))
+}
+
+// Reset reapplies the stored Config, undoing changes made to the port
+// settings behind its back, and discards both buffers
+func (p *Port) Reset() error {
+	if err := p.reconfigure(func(c *Config) {}); err != nil {
+		return p.wrapErr("Reset", err)
+	}
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	return p.wrapErr("Reset", p.flush(FlushRx|FlushTx))
+}
+
+// reconfigure applies the config as changed by fn. It holds both rl and
+// wl, so the change never races with a read or write syscall.
+func (p *Port) reconfigure(fn func(c *Config)) error {
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+	return p.reconfigureLocked(fn)
+}
+
+// reconfigureLocked is reconfigure with rl and wl held
+func (p *Port) reconfigureLocked(fn func(c *Config)) error {
+	c := p.cfg
+	fn(&c)
+	if err := p.applyConfig(&c); err != nil {
+		p.logMsg("Config", "Error %s", err)
+		return err
+	}
+	p.cfg = c
+	p.logControl("Config", c.String())
+	return nil
+}
+
+// SuspendOutput stops transmission until ResumeOutput, as if the device
+// sent XOFF, without software flow control being configured
+func (p *Port) SuspendOutput() error {
+	return p.wrapErr("SuspendOutput", p.setOutput(false))
+}
+
+// ResumeOutput restarts transmission stopped by SuspendOutput
+func (p *Port) ResumeOutput() error {
+	return p.wrapErr("ResumeOutput", p.setOutput(true))
+}
+
+// FlushWith discards the buffers selected by flags
+func (p *Port) FlushWith(flags FlushFlags) error {
+	return p.wrapErr("FlushWith", p.flush(flags))
+}
+
+// Purge discards data written to the port but not transmitted and
+// data received but not read. Use Sync to wait for the output instead.
+func (p *Port) Purge() error {
+	return p.wrapErr("Purge", p.flush(FlushAll))
+}
+
+// Flush is Purge, it discards the buffers.
+//
+// Deprecated: the name suggests writing the data out, which is what Sync
+// does. Use Purge to discard.
+func (p *Port) Flush() error {
+	return p.Purge()
+}
+
+// Available returns the number of received bytes that can be read
+// without waiting
+func (p *Port) Available() (int, error) {
+	n, err := p.available()
+	return n, p.wrapErr("Available", err)
+}
+
+// available is Available without the error wrapping
+func (p *Port) available() (int, error) {
+	n, err := p.inQueue()
+	if err != nil {
+		return 0, err
+	}
+	return n + p.pendingLen(), nil
+}
+
+// DiscardInput discards the received data like FlushWith(FlushRx) and
+// returns how many bytes were pending, e.g. to notice a device sending
+// data it shouldn't
+func (p *Port) DiscardInput() (_ int, err error) {
+	defer func() { err = p.wrapErr("DiscardInput", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	n, err := p.available()
+	if err != nil {
+		return 0, err
+	}
+	if err = p.flush(FlushRx); err != nil {
+		return 0, err
+	}
+	p.logMsg("Discard", "%d", n)
+	return n, nil
+}
+
+// Read reads up to len(buf) bytes from the port. Depending on the
+// Config it waits for at least one byte, up to ReadTimeout or not at all.
+func (p *Port) Read(buf []byte) (int, error) {
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	n, err := p.read(buf)
+	return n, p.wrapErr("Read", err)
+}
+
+// minBurstGap is the shortest pause ReadAvailable takes as the end of
+// a burst, drivers and USB adapters deliver data in slices this far apart
+const minBurstGap = 20 * time.Millisecond
+
+// ReadAvailable reads like Read, but after the first bytes it keeps
+// reading into buf until buf is full or the input pauses for longer
+// than 3.5 characters (at least minBurstGap), so that a burst sent by
+// the device is returned by one call.
+func (p *Port) ReadAvailable(buf []byte) (_ int, err error) {
+	defer func() { err = p.wrapErr("ReadAvailable", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	n, err := p.read(buf)
+	if n == 0 || err != nil {
+		return n, err
+	}
+	gap := p.cfg.FrameSilence(3.5)
+	if gap < minBurstGap {
+		gap = minBurstGap
+	}
+	for n < len(buf) {
+		ready, err := p.waitForData(gap)
+		if err != nil || !ready {
+			// the data read so far is returned, a real error recurs
+			return n, nil
+		}
+		m, err := p.read(buf[n:])
+		n += m
+		if m == 0 || err != nil {
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// ReadBurst reads a burst of bytes ended by the input pausing for gap,
+// e.g. the frame of a sensor that sends and then goes quiet. The first
+// byte is waited for like Read does, the burst is returned as soon as
+// the pause is seen or max bytes are read, a zero max is no limit.
+func (p *Port) ReadBurst(gap time.Duration, max int) (_ []byte, err error) {
+	defer func() { err = p.wrapErr("ReadBurst", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	buf := p.readChunk()
+	var res []byte
+	for max <= 0 || len(res) < max {
+		if len(res) > 0 {
+			ready, err := p.waitForData(gap)
+			if err != nil {
+				return res, err
+			}
+			if !ready {
+				break
+			}
+		}
+		chunk := buf
+		if max > 0 && max-len(res) < len(chunk) {
+			chunk = chunk[:max-len(res)]
+		}
+		n, err := p.read(chunk)
+		res = append(res, chunk[:n]...)
+		if err != nil && (len(res) == n || !isTimeout(err)) {
+			return res, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return res, nil
+}
+
+// Write writes buf to the port. With MaxWriteBytesPerSec set the data
+// is sent in chunks spaced to keep the throughput under that rate,
+// with InterByteDelay set the bytes are sent one by one. An empty buf
+// returns (0, nil) without calling the driver.
+func (p *Port) Write(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	p.wl.Lock()
+	defer p.wl.Unlock()
+	n, err = p.pacedWrite(buf)
+	if err == nil && p.cfg.FlushAfterWrite {
+		err = p.drain()
+	}
+	return n, p.wrapErr("Write", err)
+}
+
+// WriteMulti writes the buffers as one, e.g. the header, payload and
+// checksum of a frame, with a single writev on nix. Other writes can't
+// go in between. With write pacing it writes them like Write.
+func (p *Port) WriteMulti(bufs ...[]byte) (n int, err error) {
+	p.wl.Lock()
+	defer p.wl.Unlock()
+	if p.cfg.MaxWriteBytesPerSec > 0 || p.cfg.InterByteDelay > 0 {
+		n, err = p.pacedWrite(bytes.Join(bufs, nil))
+	} else {
+		n, err = p.writev(bufs)
+	}
+	if err == nil && p.cfg.FlushAfterWrite {
+		err = p.drain()
+	}
+	return n, p.wrapErr("WriteMulti", err)
+}
+
+// WriteRS485 writes buf for a manually switched RS485 transceiver: it
+// asserts RTS, waits preDelay, writes, drains, waits postDelay and
+// deasserts RTS. Other writes wait until it is done.
+func (p *Port) WriteRS485(buf []byte, preDelay, postDelay time.Duration) error {
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	// SetRts wraps its errors itself
+	if err := p.SetRts(true); err != nil {
+		return err
+	}
+	time.Sleep(preDelay)
+	_, err := p.pacedWrite(buf)
+	if err == nil {
+		err = p.drain()
+	}
+	err = p.wrapErr("WriteRS485", err)
+	time.Sleep(postDelay)
+	// release the bus even if the write failed
+	if rerr := p.SetRts(false); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// WriteWithParity sends b with the parity bit forced to 1 for mark or
+// to 0 for space, like the address bytes of a 9-bit multidrop bus. The
+// port is switched to mark / space parity for this byte and back to its
+// configuration afterwards, draining the output each time, so it is
+// slow: use it for the address only and Write for the data. Mark and
+// space parity are supported on Linux and Windows only. Other reads and
+// writes wait until it is done.
+func (p *Port) WriteWithParity(b byte, mark bool) (err error) {
+	defer func() { err = p.wrapErr("WriteWithParity", err) }()
+	// the temporary settings must not apply to a concurrent read
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	// earlier bytes must go out with the configured parity
+	if err := p.drain(); err != nil {
+		return err
+	}
+	c := p.cfg
+	c.Parity = ParitySpace
+	if mark {
+		c.Parity = ParityMark
+	}
+	if err := p.applyConfig(&c); err != nil {
+		p.logMsg("Config", "Error %s", err)
+		return err
+	}
+	_, err = p.write([]byte{b})
+	if err == nil {
+		err = p.drain()
+	}
+	// restore the configuration even if the write failed
+	if rerr := p.applyConfig(&p.cfg); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Drain waits until all data written to the port has been transmitted
+func (p *Port) Drain() error {
+	p.wl.Lock()
+	defer p.wl.Unlock()
+	return p.wrapErr("Drain", p.drain())
+}
+
+// Sync is Drain under the name of os.File.Sync: it returns when the
+// written data is on the wire (tcdrain on nix, FlushFileBuffers on
+// Windows). Purge and the deprecated Flush discard the data instead.
+func (p *Port) Sync() error {
+	return p.Drain()
+}
+
+// pacedWrite applies the write pacing options, wl must be held
+func (p *Port) pacedWrite(buf []byte) (n int, err error) {
+	rate := p.cfg.MaxWriteBytesPerSec
+	delay := p.cfg.InterByteDelay
+	if rate <= 0 && delay <= 0 {
+		return p.write(buf)
+	}
+	chunk := 1
+	if delay <= 0 {
+		// about 100ms of data per chunk
+		chunk = rate / 10
+		if chunk < 1 {
+			chunk = 1
+		}
+	}
+	for n < len(buf) {
+		if d := time.Until(p.nextWrite); d > 0 {
+			time.Sleep(d)
+		}
+		end := n + chunk
+		if end > len(buf) {
+			end = len(buf)
+		}
+		m, err := p.write(buf[n:end])
+		n += m
+
+		now := time.Now()
+		if p.nextWrite.Before(now) {
+			p.nextWrite = now
+		}
+		if rate > 0 {
+			p.nextWrite = p.nextWrite.Add(time.Duration(m) * time.Second / time.Duration(rate))
+		}
+		if t := now.Add(delay); t.After(p.nextWrite) {
+			p.nextWrite = t
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteFrom writes everything read from r until io.EOF, applying the
+// write pacing options. Other writes may go between its chunks. It
+// returns the count written and the first read or write error.
+func (p *Port) WriteFrom(r io.Reader) (n int64, err error) {
+	defer func() { err = p.wrapErr("WriteFrom", err) }()
+	buf := p.readChunk()
+	for {
+		m, rerr := r.Read(buf)
+		if m > 0 {
+			p.wl.Lock()
+			m, err = p.pacedWrite(buf[:m])
+			p.wl.Unlock()
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// BufferedWriter collects small writes to send them with one Port.Write,
+// e.g. a frame built byte by byte. Data goes out on Flush, or when the
+// buffer is full. It is not safe for concurrent use.
+type BufferedWriter struct {
+	p   *Port
+	buf []byte
+}
+
+var _ io.Writer = (*BufferedWriter)(nil)
+
+// BufferedWriter returns a BufferedWriter with a buffer of size bytes
+func (p *Port) BufferedWriter(size int) *BufferedWriter {
+	if size <= 0 {
+		size = 512
+	}
+	return &BufferedWriter{p: p, buf: make([]byte, 0, size)}
+}
+
+// Write adds b to the buffer, flushing it first if b doesn't fit.
+// Data larger than the buffer is written directly.
+func (w *BufferedWriter) Write(b []byte) (int, error) {
+	if len(w.buf)+len(b) > cap(w.buf) {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(b) > cap(w.buf) {
+		return w.p.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	return len(b), nil
+}
+
+// Flush writes the buffered data to the port. After an error the
+// unsent data stays buffered.
+func (w *BufferedWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.p.Write(w.buf)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// Buffered returns the number of bytes waiting for Flush
+func (w *BufferedWriter) Buffered() int {
+	return len(w.buf)
+}
+
+// ReadTo copies received data to w until nothing arrived for idle or
+// the port is closed or hung up, e.g. to capture a dump that ends in
+// silence. A zero idle waits until the port is closed.
+func (p *Port) ReadTo(w io.Writer, idle time.Duration) (n int64, err error) {
+	defer func() { err = p.wrapErr("ReadTo", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	timeout := idle
+	if timeout <= 0 {
+		timeout = -1
+	}
+	buf := p.readChunk()
+	for {
+		ready, err := p.waitForData(timeout)
+		if err != nil || !ready {
+			return n, eofIfClosed(err)
+		}
+		m, err := p.read(buf)
+		if m == 0 && (err == nil || isTimeout(err)) {
+			// ready without data is a hangup, poll keeps reporting it
+			return n, nil
+		}
+		if m > 0 {
+			m, werr := w.Write(buf[:m])
+			n += int64(m)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err != nil && !isTimeout(err) {
+			return n, eofIfClosed(err)
+		}
+	}
+}
+
+// eofIfClosed maps the ways a read loop ends on a closed port to nil
+func eofIfClosed(err error) error {
+	if err == io.EOF || errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// ReadAtLeast reads into buf until it has read at least min bytes.
+// It gives up after ReadTimeout, returning the count read so far and
+// ErrTimeout. Without ReadTimeout it waits like io.ReadAtLeast.
+func (p *Port) ReadAtLeast(buf []byte, min int) (int, error) {
+	if len(buf) < min {
+		return 0, io.ErrShortBuffer
+	}
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	var deadline time.Time
+	if p.cfg.ReadTimeout > 0 {
+		deadline = time.Now().Add(p.cfg.ReadTimeout)
+	}
+	n, err := p.readAtLeast(buf, min, deadline)
+	return n, p.wrapErr("ReadAtLeast", err)
+}
+
+// ReadDeadline reads until buf is full or deadline, over as many reads
+// as it takes. If the deadline passes it returns the count read so far,
+// possibly zero, and ErrTimeout. A zero deadline waits until buf is full.
+func (p *Port) ReadDeadline(buf []byte, deadline time.Time) (int, error) {
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	n, err := p.readAtLeast(buf, len(buf), deadline)
+	return n, p.wrapErr("ReadDeadline", err)
+}
+
+// ReadRune reads one character and decodes it like the text column of
+// the log: with LogDecoder if set, else with LogCharset, where UTF8
+// reads a whole sequence and gives utf8.RuneError for an invalid one;
+// a byte cutting a sequence short is left for the next read. It returns
+// the number of bytes read, like io.RuneReader, and gives up after
+// ReadTimeout with ErrTimeout.
+func (p *Port) ReadRune() (r rune, size int, err error) {
+	defer func() { err = p.wrapErr("ReadRune", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	deadline := p.opDeadline(0)
+	var b [utf8.UTFMax]byte
+	if _, err = p.readAtLeast(b[:1], 1, deadline); err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case p.cfg.LogDecoder != nil:
+		return p.cfg.LogDecoder(b[0]), 1, nil
+	case p.cfg.LogCharset != UTF8:
+		return p.cfg.LogCharset.decode(b[0]), 1, nil
+	case b[0] < utf8.RuneSelf:
+		return rune(b[0]), 1, nil
+	}
+	// the length of the sequence from its first byte
+	switch {
+	case b[0] >= 0xC2 && b[0] <= 0xDF:
+		size = 2
+	case b[0] >= 0xE0 && b[0] <= 0xEF:
+		size = 3
+	case b[0] >= 0xF0 && b[0] <= 0xF4:
+		size = 4
+	default:
+		return utf8.RuneError, 1, nil
+	}
+	for n := 1; n < size; n++ {
+		if _, err = p.readAtLeast(b[n:n+1], 1, deadline); err != nil {
+			return 0, n, err
+		}
+		if b[n]&0xC0 != 0x80 {
+			// not a continuation byte, it starts the next character
+			p.unread(b[n])
+			return utf8.RuneError, n, nil
+		}
+	}
+	r, _ = utf8.DecodeRune(b[:size])
+	return r, size, nil
+}
+
+// readAtLeast reads at least min bytes into buf before deadline,
+// a zero deadline waits forever. rl must be held.
+func (p *Port) readAtLeast(buf []byte, min int, deadline time.Time) (n int, err error) {
+	for n < min {
+		timeout := time.Duration(-1)
+		if !deadline.IsZero() {
+			if timeout = time.Until(deadline); timeout <= 0 {
+				return n, ErrTimeout
+			}
+		}
+		ready, err := p.waitForData(timeout)
+		if err != nil {
+			return n, err
+		}
+		if !ready {
+			return n, ErrTimeout
+		}
+		m, err := p.read(buf[n:])
+		n += m
+		if err != nil && !isTimeout(err) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadLine reads until the end of line sequence eol, e.g. "\r\n", and
+// returns the line, without eol if strip is set. Like ReadUntil it gives
+// up after timeout, returning the partial line and ErrTimeout.
+func (p *Port) ReadLine(eol []byte, strip bool, timeout time.Duration) (string, error) {
+	if len(eol) == 0 {
+		return "", p.wrapErr("ReadLine", SerialError{Msg: "Empty end of line"})
+	}
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	deadline := p.opDeadline(timeout)
+	var line []byte
+	last := eol[len(eol)-1]
+	for {
+		b, err := p.readUntil(last, deadline)
+		line = append(line, b...)
+		if err != nil {
+			return string(line), p.wrapErr("ReadLine", err)
+		}
+		// a last byte of eol alone, e.g. a LF without the CR, goes on
+		if bytes.HasSuffix(line, eol) {
+			break
+		}
+	}
+	if strip {
+		line = line[:len(line)-len(eol)]
+	}
+	return string(line), nil
+}
+
+// ReadUntil reads until delim is received, returning the data including
+// delim. It gives up after timeout, returning the data read so far and
+// ErrTimeout. A zero timeout uses ReadTimeout, without ReadTimeout it
+// waits for delim forever.
+func (p *Port) ReadUntil(delim byte, timeout time.Duration) ([]byte, error) {
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	b, err := p.readUntil(delim, p.opDeadline(timeout))
+	return b, p.wrapErr("ReadUntil", err)
+}
+
+// opDeadline returns the deadline of a helper taking timeout, which is
+// ReadTimeout if zero. The zero time means no deadline.
+func (p *Port) opDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		timeout = p.cfg.ReadTimeout
+	}
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// readUntil reads until delim or deadline, rl must be held.
+// It reads byte by byte so that nothing after delim is consumed.
+func (p *Port) readUntil(delim byte, deadline time.Time) ([]byte, error) {
+	var res []byte
+	b := make([]byte, 1)
+	for {
+		n, err := p.readAtLeast(b, 1, deadline)
+		res = append(res, b[:n]...)
+		if err != nil {
+			return res, err
+		}
+		if b[0] == delim {
+			return res, nil
+		}
+	}
+}
+
+// Transaction discards pending input, writes req and reads the response
+// up to and including respDelim. It returns ErrTimeout with the partial
+// response if respDelim doesn't arrive within timeout, a zero timeout
+// uses ReadTimeout. Other reads and writes wait until it is done.
+func (p *Port) Transaction(req []byte, respDelim byte, timeout time.Duration) ([]byte, error) {
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	if err := p.flush(FlushRx); err != nil {
+		return nil, p.wrapErr("Transaction", err)
+	}
+	resp, err := p.exchange(req, respDelim, timeout)
+	return resp, p.wrapErr("Transaction", err)
+}
+
+// Ping measures the round trip to the device: it discards pending
+// input, writes probe and reads up to and including respDelim like
+// Transaction, returning the time from the write to the response.
+// On error the time until the failure is returned.
+func (p *Port) Ping(probe []byte, respDelim byte, timeout time.Duration) (_ time.Duration, err error) {
+	defer func() { err = p.wrapErr("Ping", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	if err := p.flush(FlushRx); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	_, err = p.exchange(probe, respDelim, timeout)
+	return time.Since(start), err
+}
+
+// exchange writes req and reads the response up to respDelim, rl and
+// wl must be held
+func (p *Port) exchange(req []byte, respDelim byte, timeout time.Duration) ([]byte, error) {
+	if _, err := p.pacedWrite(req); err != nil {
+		return nil, err
+	}
+	return p.readUntil(respDelim, p.opDeadline(timeout))
+}
+
+// DiscardUntilIdle reads and discards input until nothing arrived for
+// idle, e.g. to skip boot chatter after a reset. It returns ErrTimeout
+// if the line is still busy after max, a zero max waits forever.
+func (p *Port) DiscardUntilIdle(idle time.Duration, max time.Duration) (err error) {
+	defer func() { err = p.wrapErr("DiscardUntilIdle", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+
+	var deadline time.Time
+	if max > 0 {
+		deadline = time.Now().Add(max)
+	}
+	buf := p.readChunk()
+	for {
+		timeout := idle
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return ErrTimeout
+			}
+			if left < timeout {
+				timeout = left
+			}
+		}
+		ready, err := p.waitForData(timeout)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			if timeout == idle {
+				return nil
+			}
+			return ErrTimeout
+		}
+		if _, err := p.read(buf); err != nil && !isTimeout(err) {
+			return err
+		}
+	}
+}
+
+// Loopback writes pattern and reads it back through a physical or
+// internal loopback, to check a port and its cable. It returns an error
+// describing the first mismatch or how much came back before timeout.
+// A zero timeout uses ReadTimeout, without ReadTimeout it waits for the
+// whole pattern forever.
+func (p *Port) Loopback(pattern []byte, timeout time.Duration) (err error) {
+	defer func() { err = p.wrapErr("Loopback", err) }()
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	if err := p.flush(FlushRx); err != nil {
+		return err
+	}
+	if _, err := p.pacedWrite(pattern); err != nil {
+		return err
+	}
+	buf := make([]byte, len(pattern))
+	n, err := p.readAtLeast(buf, len(buf), p.opDeadline(timeout))
+	for i := 0; i < n; i++ {
+		if buf[i] != pattern[i] {
+			return SerialError{Tag: "Loopback",
+				Msg: fmt.Sprintf("Byte %d sent %02X received %02X", i, pattern[i], buf[i])}
+		}
+	}
+	if err == ErrTimeout {
+		return SerialError{Tag: "Loopback",
+			Msg: fmt.Sprintf("Timeout, received %d of %d bytes", n, len(pattern))}
+	}
+	return err
+}
+
+// isTimeout reports whether err is a read timeout of any read mode
+func isTimeout(err error) bool {
+	// a non-blocking read may find nothing after a spurious wakeup
+	return err == ErrTimeout || err == ErrWouldBlock || errors.Is(err, os.ErrDeadlineExceeded)
+}
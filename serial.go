@@ -1,15 +1,18 @@
 package serial
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/istperm/utils"
-	//"main/utils"
+	"unicode/utf8"
 )
 
 type Config struct {
@@ -17,31 +20,383 @@ type Config struct {
 	Baud        int
 	ReadTimeout time.Duration
 	LogFile     string
+	LogCharset  LogCharset
+	LogDecoder  ByteDecoder // replaces LogCharset when set
+
+	// RawCaptureFile and RawCaptureTxFile receive the bytes read from
+	// and written to the port verbatim, e.g. to replay a session in a
+	// simulator. They are appended to like LogFile and independent of it.
+	RawCaptureFile   string
+	RawCaptureTxFile string
+
+	// LogOffsets prefixes the hex dump lines with the offset of their
+	// first byte in the data received or sent, e.g. "+ +0x0040:". The
+	// counters belong to the port, they go on when the log file is
+	// rotated.
+	LogOffsets bool
+
+	// NonBlocking makes Read return immediately with whatever data
+	// is available, possibly none. ReadTimeout is ignored.
+	NonBlocking bool
+
+	// MinBytes is used as VMIN on nix when set: Read blocks until that
+	// many bytes (up to 255) arrived, or ReadTimeout passed without a
+	// byte once the first one came in. Ignored with NonBlocking and
+	// UseDeadlines, and on Windows.
+	//
+	// Set it to the frame size to have Read return once per frame of a
+	// stream instead of per few bytes. ReadTimeout is then the gap that
+	// ends a short frame, rounded to 0.1s, and no longer bounds the wait
+	// for the first byte: Read waits for that as long as it takes.
+	MinBytes int
+
+	// ReadChunkSize sizes the working buffer of helper loops that read
+	// in chunks, like DiscardUntilIdle; zero means 512. Use a large one
+	// for high throughput streams, a small one for interactive use.
+	// Direct Read calls use the caller's buffer, ReadUntil reads byte
+	// by byte so that nothing past the delimiter is consumed.
+	ReadChunkSize int
+
+	// ReadRetries retries a read failing with a transient error like
+	// EIO on a noisy USB link up to that many times (nix only)
+	ReadRetries int
+
+	// SilentTimeout makes Read return (0, nil) instead of ErrTimeout
+	// when no data arrived within ReadTimeout, as older versions did.
+	SilentTimeout bool
+
+	// NoAssertDSR clears the "Assert DSR" bit (DTR_CONTROL_ENABLE)
+	// the Windows DCB sets by default. Ignored on other platforms.
+	NoAssertDSR bool
+
+	// DisableReceiver clears CREAD for transmit-only links (nix only)
+	DisableReceiver bool
+
+	// Canonical leaves ICANON on so Read returns whole lines (nix only)
+	Canonical bool
+
+	// Echo turns on local echo of received characters (nix only)
+	Echo bool
+
+	// DetectBreak reports received breaks, e.g. as frame boundaries:
+	// Read returns the data before a break, then 0 and ErrBreak (nix only)
+	DetectBreak bool
+
+	// MarkParityErrors passes bytes received with a parity error as
+	// FF 00 <byte> and a FF data byte as FF FF, e.g. for 9-bit multidrop
+	// protocols using mark / space parity. Without DetectBreak a break
+	// reads as FF 00 00 (nix only)
+	MarkParityErrors bool
+
+	// DataBits is the character size, 5 to 8; zero means 8
+	DataBits int
+	Parity   Parity
+	StopBits StopBits
+
+	// FlowControl selects hardware or software flow control, see also
+	// SetFlowControl
+	FlowControl FlowControl
+
+	// CRLFTranslate maps NL to CR-NL on output and CR to NL on input.
+	// Windows has no driver support, the translation is done in software.
+	CRLFTranslate bool
+
+	// MaxWriteBytesPerSec paces Write to the given throughput for devices
+	// without flow control. Zero means unthrottled.
+	MaxWriteBytesPerSec int
+
+	// InterByteDelay makes Write send one byte at a time with this
+	// gap between them, for devices with a one byte input buffer.
+	InterByteDelay time.Duration
+
+	// FlushAfterWrite makes Write wait until the data is transmitted,
+	// see Drain, e.g. for half-duplex devices. It adds latency.
+	FlushAfterWrite bool
+
+	// UseDeadlines keeps the port in the Go runtime poller (Linux only,
+	// opening fails on the other nix systems).
+	// ReadTimeout is then applied as a read deadline, allowing any
+	// duration instead of the 0.1s..25.5s VTIME range, and Read
+	// returns os.ErrDeadlineExceeded on timeout.
+	UseDeadlines bool
+
+	// InheritFD lets child processes inherit the descriptor of the port
+	// (nix only). By default it is closed on exec, so that a forked
+	// helper can't interfere with the device. Windows handles are
+	// never inherited.
+	InheritFD bool
+
+	// KeepNonBlock leaves the descriptor in non-blocking mode for use
+	// with an external event loop (Linux only, opening fails on the
+	// other nix systems): Read returns ErrWouldBlock instead of
+	// waiting. Get the descriptor through File().SyscallConn(),
+	// File().Fd() would make it blocking.
+	KeepNonBlock bool
+
+	// WriteTimeout bounds a Write on Windows, which then returns the
+	// count actually transmitted and ErrTimeout. On Linux use
+	// UseDeadlines and SetWriteDeadline instead.
+	WriteTimeout time.Duration
+
+	// OpenTimeout bounds opening on Windows, where a hung driver can
+	// block CreateFile or SetCommState. OpenPort then fails with
+	// ErrTimeout. Ignored on other platforms.
+	OpenTimeout time.Duration
+
+	// FlushTimeout bounds Drain and FlushWith on Windows, where a stalled
+	// driver can block FlushFileBuffers or PurgeComm. They then return
+	// ErrTimeout, leaving the call running in the background. Ignored on
+	// other platforms.
+	FlushTimeout time.Duration
 
-	// Size     int
-	// Parity   SomeNewTypeToGetCorrectDefaultOf_None
-	StopBits int
+	// RxFIFOTrigger sets the receive FIFO trigger level of a 16550 type
+	// UART in bytes and turns on the driver's low latency mode (Linux
+	// only). The driver rounds it to a level the UART supports, opening
+	// fails if it has no such setting. Zero leaves the driver default.
+	RxFIFOTrigger int
+
+	// DrainOnClose makes Close wait until the written data is
+	// transmitted, see Drain, so that the last bytes aren't lost by
+	// drivers discarding them. FlushOnClose discards the buffers instead,
+	// see Purge; with both the output is drained first.
+	DrainOnClose bool
+	FlushOnClose bool
+
+	// DropDTROnClose and DropRTSOnClose deassert the line before the port
+	// is closed, e.g. for an orderly modem hangup. Otherwise the OS
+	// default applies.
+	DropDTROnClose bool
+	DropRTSOnClose bool
+
+	// WrapError, if set, is applied to the errors returned by the
+	// methods of the port, with the method name as op, e.g. to add the
+	// device to them. Compare the results with errors.Is then. Methods
+	// built on others, like Sync on Drain, pass on their errors, which
+	// are wrapped once. WithBaud returns the error of fn as it is.
+	WrapError func(op string, err error) error
+
+	// NoLogControl leaves the control events, like modem line changes and
+	// reads, configuration changes and hangups, out of the log, which
+	// then only has the data and errors
+	NoLogControl bool
+}
+
+// Standard baud rates, see StandardBauds for those a platform supports
+const (
+	Baud50      = 50
+	Baud75      = 75
+	Baud110     = 110
+	Baud134     = 134
+	Baud150     = 150
+	Baud200     = 200
+	Baud300     = 300
+	Baud600     = 600
+	Baud1200    = 1200
+	Baud1800    = 1800
+	Baud2400    = 2400
+	Baud4800    = 4800
+	Baud9600    = 9600
+	Baud14400   = 14400
+	Baud19200   = 19200
+	Baud38400   = 38400
+	Baud57600   = 57600
+	Baud115200  = 115200
+	Baud128000  = 128000
+	Baud230400  = 230400
+	Baud256000  = 256000
+	Baud460800  = 460800
+	Baud500000  = 500000
+	Baud576000  = 576000
+	Baud921600  = 921600
+	Baud1000000 = 1000000
+	Baud1152000 = 1152000
+	Baud1500000 = 1500000
+	Baud2000000 = 2000000
+	Baud2500000 = 2500000
+	Baud3000000 = 3000000
+	Baud3500000 = 3500000
+	Baud4000000 = 4000000
+)
+
+// StandardBauds returns the standard rates supported by the backend in
+// ascending order. Linux and Windows take other rates too.
+func StandardBauds() []int {
+	return append([]int(nil), standardBauds...)
+}
+
+// Parity is the parity mode, zero means none
+type Parity byte
+
+const (
+	ParityNone  Parity = 'N'
+	ParityOdd   Parity = 'O'
+	ParityEven  Parity = 'E'
+	ParityMark  Parity = 'M' // Linux and Windows only
+	ParitySpace Parity = 'S' // Linux and Windows only
+)
+
+// StopBits is the number of stop bits, zero means one
+type StopBits int
+
+const (
+	StopBits1     StopBits = 1
+	StopBits2     StopBits = 2
+	StopBits1Half StopBits = 15 // 1.5, on nix only with 5 data bits
+)
+
+// FlowControl is the flow control mode, zero means none
+type FlowControl int
+
+const (
+	FlowNone    FlowControl = iota
+	FlowRTSCTS              // hardware, RTS / CTS
+	FlowXONXOFF             // software, XON / XOFF characters
+)
+
+// FlushFlags select the buffers FlushWith discards
+type FlushFlags int
+
+const (
+	// FlushRx discards data received but not read
+	FlushRx FlushFlags = 1 << iota
+	// FlushTx discards data written but not transmitted
+	FlushTx
+	// AbortRx aborts pending reads (Windows only)
+	AbortRx
+	// AbortTx aborts pending writes (Windows only)
+	AbortTx
+
+	// FlushAll is what Flush does
+	FlushAll = FlushRx | FlushTx | AbortRx | AbortTx
+)
+
+// PortInfo describes the device behind a port, see DeviceInfo. The USB
+// fields are empty for other devices.
+type PortInfo struct {
+	Name         string
+	VID, PID     string // USB vendor and product id in hex, e.g. "0403"
+	SerialNumber string
+	Manufacturer string
+	Product      string
+}
+
+// LinkStatus is the state of a port as reported by Probe
+type LinkStatus struct {
+	Open           bool
+	CTS, DSR, DCD  bool
+	BytesAvailable int
+	Error          error // what couldn't be queried, the rest is valid
+}
 
-	// RTSFlowControl bool
-	// DTRFlowControl bool
-	// XONFlowControl bool
-	// CRLFTranslate bool
+// Lines holds the state of the modem control lines
+type Lines struct {
+	// inputs
+	CTS, DSR, RI, DCD bool
+	// outputs
+	DTR, RTS bool
+}
+
+// String lists the lines with + for on and - for off, e.g. "CTS+ DSR- ..."
+func (l Lines) String() string {
+	var sb strings.Builder
+	for i, v := range []bool{l.CTS, l.DSR, l.RI, l.DCD, l.DTR, l.RTS} {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString([]string{"CTS", "DSR", "RI", "DCD", "DTR", "RTS"}[i])
+		if v {
+			sb.WriteByte('+')
+		} else {
+			sb.WriteByte('-')
+		}
+	}
+	return sb.String()
+}
+
+// modemLinesString describes a SetModemLines call for the log
+func modemLinesString(dtr, rts *bool) string {
+	var s []string
+	if dtr != nil {
+		s = append(s, "DTR="+strconv.FormatBool(*dtr))
+	}
+	if rts != nil {
+		s = append(s, "RTS="+strconv.FormatBool(*rts))
+	}
+	return strings.Join(s, " ")
 }
 
 type BasePort struct {
 	f      *os.File
+	cfg    Config
+	dev    string     // Name with symlinks resolved, for sysfs lookups (nix)
+	rl     sync.Mutex // read lock, taken before wl when both are needed
+	wl     sync.Mutex // write lock
+	lineMu sync.Mutex // serializes the changes of DTR and RTS (nix)
 	logger *log.Logger
 	logTag rune
 	logBuf [128]byte
 	logPtr int
+	rxOff  int64 // bytes logged per direction, LogOffsets
+	txOff  int64
+
+	charset LogCharset
+	decoder ByteDecoder
+	utfBuf  [utf8.UTFMax]byte
+	utfLen  int
+
+	// earliest time of the next paced write
+	nextWrite time.Time
+
+	// received data not returned yet and a break to report, DetectBreak.
+	// pendMu guards them, Read doesn't hold it while waiting like rl.
+	pendMu  sync.Mutex
+	rxPend  []byte
+	rxBreak bool
+
+	// RawCaptureFile and RawCaptureTxFile
+	rxCapture, txCapture *os.File
+
+	// read mode to restore, while SetBlocking(true) is in effect
+	unblocked *readMode
+
+	closed atomic.Bool
+
+	// lines seen by the last Probe, which logs only changes
+	probeMu    sync.Mutex
+	probed     bool
+	probeLines Lines
+
+	errMu     sync.Mutex
+	stickyOp  string
+	stickyErr error // see Port.Err
+}
+
+// readMode holds the Config fields selecting how Read waits
+type readMode struct {
+	ReadTimeout time.Duration
+	NonBlocking bool
+	MinBytes    int
 }
 
 type SerialError struct {
 	Tag string
 	Msg string
 	Cod int
+	Err error // underlying error, if any
 }
 
+// hangUpTime is how long HangUp keeps the line dropped
+const hangUpTime = 500 * time.Millisecond
+
+// ErrTimeout is returned by Read when no data arrived within ReadTimeout
+var ErrTimeout = SerialError{Msg: "Timeout"}
+
+// ErrWouldBlock is returned by Read when no data is there, see KeepNonBlock
+var ErrWouldBlock = SerialError{Msg: "Would block"}
+
+// ErrBreak is returned by Read where a break was received, see DetectBreak
+var ErrBreak = SerialError{Msg: "Break"}
+
 func (se SerialError) Error() string {
 	var sb strings.Builder
 	if se.Tag != "" {
@@ -51,21 +406,414 @@ func (se SerialError) Error() string {
 	if se.Cod != 0 {
 		sb.WriteString(" [" + strconv.Itoa(se.Cod) + "]")
 	}
+	if se.Err != nil {
+		sb.WriteString(": " + se.Err.Error())
+	}
+	return sb.String()
+}
+
+func (se SerialError) Unwrap() error {
+	return se.Err
+}
+
+// SetMode7E1 selects 7 data bits, even parity and one stop bit, the
+// usual framing of legacy ASCII instruments. On nix ISTRIP is set for
+// 7 data bits, so the parity bit never shows up as the high bit.
+func (c *Config) SetMode7E1() {
+	c.DataBits = 7
+	c.Parity = ParityEven
+	c.StopBits = StopBits1
+}
+
+// Set8N1 selects 8 data bits, no parity and one stop bit, the default
+func (c *Config) Set8N1() {
+	c.DataBits = 8
+	c.Parity = ParityNone
+	c.StopBits = StopBits1
+}
+
+// dataBits returns the validated character size
+func (c *Config) dataBits() (int, error) {
+	switch c.DataBits {
+	case 0:
+		return 8, nil
+	case 5, 6, 7, 8:
+		return c.DataBits, nil
+	}
+	return 0, SerialError{Msg: "Unsupported data bits", Cod: c.DataBits}
+}
+
+// CharTime returns the time one character takes on the line: start
+// bit, data bits, parity bit and stop bits. It is zero without a baud
+// rate.
+func (c *Config) CharTime() time.Duration {
+	if c.Baud <= 0 {
+		return 0
+	}
+	// counted in half bits for 1.5 stop bits
+	bits, err := c.dataBits()
+	if err != nil {
+		bits = 8
+	}
+	half := 2 + 2*bits
+	if c.Parity != 0 && c.Parity != ParityNone {
+		half += 2
+	}
+	switch c.StopBits {
+	case StopBits2:
+		half += 4
+	case StopBits1Half:
+		half += 3
+	default:
+		half += 2
+	}
+	return time.Duration(half) * time.Second / time.Duration(2*c.Baud)
+}
+
+// FrameSilence returns the time of chars characters, e.g. 3.5 for the
+// gap between Modbus RTU frames
+func (c *Config) FrameSilence(chars float64) time.Duration {
+	return time.Duration(chars * float64(c.CharTime()))
+}
+
+// String renders the config compactly, e.g. "COM3 115200 8N1 rt=500ms"
+func (c Config) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.Name + " " + strconv.Itoa(c.Baud) + " ")
+	if c.DataBits == 0 {
+		sb.WriteString("8")
+	} else {
+		sb.WriteString(strconv.Itoa(c.DataBits))
+	}
+	if c.Parity == 0 {
+		sb.WriteByte(byte(ParityNone))
+	} else {
+		sb.WriteByte(byte(c.Parity))
+	}
+	switch c.StopBits {
+	case 0:
+		sb.WriteString("1")
+	case StopBits1Half:
+		sb.WriteString("1.5")
+	default:
+		sb.WriteString(strconv.Itoa(int(c.StopBits)))
+	}
+	switch c.FlowControl {
+	case FlowRTSCTS:
+		sb.WriteString(" rtscts")
+	case FlowXONXOFF:
+		sb.WriteString(" xonxoff")
+	}
+	if c.NonBlocking {
+		sb.WriteString(" nonblock")
+	} else if c.ReadTimeout > 0 {
+		sb.WriteString(" rt=" + c.ReadTimeout.String())
+	}
 	return sb.String()
 }
 
-// OpenPort opens a serial port with the specified configuration
+// Clone returns a copy of the config that can be changed without
+// affecting the original. Reference fields must be deep-copied here
+// as they are added; funcs like LogDecoder are shared as they are.
+func (c *Config) Clone() *Config {
+	n := *c
+	return &n
+}
+
+// OpenPort opens a serial port with the specified configuration.
+// If only the log file can't be opened, the port is returned usable
+// without logging, together with a SerialError tagged "Log".
 func OpenPort(c *Config) (*Port, error) {
 	//return openPort(c.Name, c.Baud, c.ReadTimeout)
 	// call platform-specific function
 	p, err := openPort(c)
-	if p != nil && err == nil && c.LogFile != "" {
-		err = p.openLog(c.LogFile)
-		p.logMsg("Open", c.Name)
+	if err != nil {
+		return nil, SerialError{Tag: "Open", Msg: c.String(), Err: err}
+	}
+	return p, p.setup(c)
+}
+
+// PortEvent reports a port that appeared or disappeared, see WatchPorts
+type PortEvent struct {
+	Name  string
+	Added bool
+}
+
+// portPollInterval is how often WatchPorts lists the ports where it
+// can't be notified
+const portPollInterval = time.Second
+
+// pollPorts reports the changes between calls of list every interval
+// until stop is called
+func pollPorts(list func() []string, interval time.Duration) (<-chan PortEvent, func()) {
+	events := make(chan PortEvent, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(events)
+		known := map[string]bool{}
+		for _, name := range list() {
+			known[name] = true
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			var changes []PortEvent
+			now := map[string]bool{}
+			for _, name := range list() {
+				now[name] = true
+				if !known[name] {
+					changes = append(changes, PortEvent{name, true})
+				}
+			}
+			for name := range known {
+				if !now[name] {
+					changes = append(changes, PortEvent{name, false})
+				}
+			}
+			known = now
+			sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+			for _, ev := range changes {
+				select {
+				case events <- ev:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return events, func() { once.Do(func() { close(done) }) }
+}
+
+// SerialPort is the platform independent part of Port, for code that
+// should work with other implementations too, e.g. a mock in tests
+type SerialPort interface {
+	io.ReadWriteCloser
+	Name() string
+	FlushWith(flags FlushFlags) error
+	Drain() error
+	SetDtr(v bool) error
+	SetRts(v bool) error
+	Lines() (Lines, error)
+	SetBaud(baud int) error
+	SetReadTimeout(timeout time.Duration) error
+}
+
+// Open is OpenPort returning the SerialPort interface. Use OpenPort for
+// the platform specific methods of Port.
+func Open(c *Config) (SerialPort, error) {
+	p, err := OpenPort(c)
+	if p == nil {
+		// not a non-nil interface holding a nil *Port
+		return nil, err
 	}
 	return p, err
 }
 
+// OpenFD opens a port on a descriptor obtained elsewhere, e.g. passed
+// by a helper holding the device permissions, instead of by c.Name,
+// which is only used for logging then. On Windows fd is a
+// syscall.Handle opened with FILE_FLAG_OVERLAPPED. The port owns fd and
+// closes it, also if the configuration fails.
+func OpenFD(fd uintptr, c *Config) (*Port, error) {
+	p, err := openFD(fd, c)
+	if err != nil {
+		return nil, SerialError{Tag: "Open", Msg: c.String(), Err: err}
+	}
+	return p, p.setup(c)
+}
+
+// setup stores the config of the newly opened port and opens the log
+// and capture files. One failing doesn't keep the others from opening,
+// the first error is returned.
+func (p *Port) setup(c *Config) (err error) {
+	p.cfg = *c
+	if c.LogFile != "" {
+		p.charset = c.LogCharset
+		p.decoder = c.LogDecoder
+		if lerr := p.openLog(c.LogFile); lerr != nil {
+			err = SerialError{Tag: "Log", Msg: c.LogFile, Err: lerr}
+		} else {
+			p.logMsg("Open", c.Name)
+		}
+	}
+	var cerr error
+	if c.RawCaptureFile != "" {
+		if p.rxCapture, cerr = openCapture(c.RawCaptureFile); cerr != nil && err == nil {
+			err = SerialError{Tag: "Capture", Msg: c.RawCaptureFile, Err: cerr}
+		}
+	}
+	if c.RawCaptureTxFile != "" {
+		if p.txCapture, cerr = openCapture(c.RawCaptureTxFile); cerr != nil && err == nil {
+			err = SerialError{Tag: "Capture", Msg: c.RawCaptureTxFile, Err: cerr}
+		}
+	}
+	return err
+}
+
+func openCapture(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// OpenPortWithRetry calls OpenPort up to attempts times with delay
+// between tries while the port is missing or access to it is denied,
+// e.g. while a USB adapter is being enumerated. Other errors fail fast.
+func OpenPortWithRetry(c *Config, attempts int, delay time.Duration) (p *Port, err error) {
+	for i := 0; ; i++ {
+		p, err = OpenPort(c)
+		if err == nil || p != nil || i+1 >= attempts {
+			return
+		}
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+// setErr records err of the operation op as the sticky error unless
+// there is one already or err is a timeout, a would-block or a break,
+// which the next call may not see again
+func (p *BasePort) setErr(op string, err error) {
+	if err == nil || err == ErrBreak || isTimeout(err) {
+		return
+	}
+	p.errMu.Lock()
+	if p.stickyErr == nil {
+		p.stickyOp, p.stickyErr = op, err
+	}
+	p.errMu.Unlock()
+}
+
+// wrapErr passes an error returned by the operation op through
+// Config.WrapError
+func (p *BasePort) wrapErr(op string, err error) error {
+	if err == nil || p.cfg.WrapError == nil {
+		return err
+	}
+	return p.cfg.WrapError(op, err)
+}
+
+// readChunk returns a working buffer for the chunked read loops
+func (p *BasePort) readChunk() []byte {
+	if p.cfg.ReadChunkSize > 0 {
+		return make([]byte, p.cfg.ReadChunkSize)
+	}
+	return make([]byte, 512)
+}
+
+// pendingReady reports whether a Read returns the held back data or
+// break without waiting
+func (p *BasePort) pendingReady() bool {
+	p.pendMu.Lock()
+	defer p.pendMu.Unlock()
+	if !p.cfg.DetectBreak {
+		return len(p.rxPend) > 0
+	}
+	return p.rxBreak || p.rxComplete()
+}
+
+// pendingLen returns the number of held back bytes
+func (p *BasePort) pendingLen() int {
+	p.pendMu.Lock()
+	defer p.pendMu.Unlock()
+	return len(p.rxPend)
+}
+
+// unread puts b back in front of the held back input, so that the next
+// read returns it first. With DetectBreak the input is kept as marked
+// by the driver, where a FF data byte is doubled.
+func (p *BasePort) unread(b byte) {
+	p.pendMu.Lock()
+	defer p.pendMu.Unlock()
+	if p.cfg.DetectBreak && b == 0xFF {
+		p.rxPend = append([]byte{0xFF, 0xFF}, p.rxPend...)
+	} else {
+		p.rxPend = append([]byte{b}, p.rxPend...)
+	}
+}
+
+// takePending moves the bytes given back by unread to buf, without
+// DetectBreak
+func (p *BasePort) takePending(buf []byte) int {
+	p.pendMu.Lock()
+	defer p.pendMu.Unlock()
+	n := copy(buf, p.rxPend)
+	p.rxPend = p.rxPend[:copy(p.rxPend, p.rxPend[n:])]
+	return n
+}
+
+// rxComplete reports whether rxPend holds more than an incomplete mark,
+// pendMu must be held
+func (p *BasePort) rxComplete() bool {
+	src := p.rxPend
+	switch {
+	case len(src) == 0:
+		return false
+	case src[0] != 0xFF || len(src) >= 3:
+		return true
+	case len(src) == 2:
+		return src[1] != 0x00
+	}
+	return false
+}
+
+// dropPending discards the held back data for FlushRx
+func (p *BasePort) dropPending(flags FlushFlags) {
+	if flags&FlushRx != 0 {
+		p.pendMu.Lock()
+		defer p.pendMu.Unlock()
+		p.rxPend = p.rxPend[:0]
+		p.rxBreak = false
+	}
+}
+
+// OpenFirstMatch opens the first port, in name order, whose name matches
+// the shell pattern glob, e.g. "/dev/ttyUSB*" or "COM*". The other
+// settings are taken from c. If none opens the errors are joined.
+func OpenFirstMatch(glob string, c *Config) (*Port, error) {
+	names, err := matchPorts(glob)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, SerialError{Tag: "Open", Msg: "No port matches " + glob}
+	}
+	var errs []error
+	for _, name := range names {
+		cc := c.Clone()
+		cc.Name = name
+		p, err := OpenPort(cc)
+		if p != nil {
+			return p, err
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// emptyRead returns the error reported for a read started at start
+// that got no data
+func (p *BasePort) emptyRead(start time.Time) error {
+	switch {
+	case p.cfg.NonBlocking:
+		return nil
+	case p.cfg.ReadTimeout > 0 && time.Since(start) >= p.cfg.ReadTimeout/4:
+		// VTIME rounds down to 0.1s, hence the margin
+		if p.cfg.SilentTimeout {
+			return nil
+		}
+		return ErrTimeout
+	}
+	// a read returns nothing before its timeout only on hangup
+	return io.EOF
+}
+
 func (p *BasePort) openLog(logFile string) error {
 	f, e := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if e == nil {
@@ -74,6 +822,13 @@ func (p *BasePort) openLog(logFile string) error {
 	return e
 }
 
+// logControl logs a control event unless NoLogControl is set
+func (p *BasePort) logControl(tag string, msg string, arg ...interface{}) {
+	if !p.cfg.NoLogControl {
+		p.logMsg(tag, msg, arg...)
+	}
+}
+
 func (p *BasePort) logMsg(tag string, msg string, arg ...interface{}) {
 	if p.logger == nil {
 		return
@@ -86,12 +841,14 @@ func (p *BasePort) logMsg(tag string, msg string, arg ...interface{}) {
 }
 
 func (p *BasePort) logData(tag rune, data []byte) {
+	p.capture(tag, data)
 	if p.logger == nil {
 		return
 	}
 	if tag != p.logTag {
 		p.logFlush()
 		p.logTag = tag
+		p.utfLen = 0
 	}
 	for i := 0; i < len(data); i++ {
 		if p.logPtr >= len(p.logBuf) {
@@ -109,29 +866,98 @@ func (p *BasePort) logFlush() {
 		if tag == 0 {
 			tag = ' '
 		}
+		off := &p.rxOff
+		if tag == '-' {
+			off = &p.txOff
+		}
+		prefix := func(i int) string {
+			if !p.cfg.LogOffsets {
+				return string(tag)
+			}
+			return fmt.Sprintf("%c +0x%04X:", tag, *off+int64(i))
+		}
 		for i := 0; i < p.logPtr; i++ {
 			if i%16 == 0 && hex.Cap() > 0 {
-				p.logger.Printf("%c %s %s", tag, hex.String(), asc.String())
+				p.logger.Printf("%s %s %s", prefix(i-16), hex.String(), asc.String())
 				hex.Reset()
 				asc.Reset()
 			}
 			b := p.logBuf[i]
 			hex.WriteString(fmt.Sprintf("%02X ", b))
-			r := '.'
-			if b >= 0x20 {
-				r = utils.CharToRune(b)
-			}
-			asc.WriteRune(r)
+			p.logChar(&asc, b)
 		}
 		if hex.Cap() > 0 {
-			p.logger.Printf("%c %-48s %s", tag, hex.String(), asc.String())
+			p.logger.Printf("%s %-48s %s", prefix((p.logPtr-1)/16*16), hex.String(), asc.String())
 		}
+		*off += int64(p.logPtr)
 	}
 	p.logPtr = 0
 }
 
+// Name returns the port name as given in the Config
+func (p *BasePort) Name() string {
+	return p.cfg.Name
+}
+
+// File returns the underlying file of the port. Reading or writing it
+// directly bypasses the port locks and logging.
+func (p *BasePort) File() *os.File {
+	return p.f
+}
+
+// SetDeadline sets both the read and write deadlines, see SetReadDeadline
+func (p *BasePort) SetDeadline(t time.Time) error {
+	if !p.cfg.UseDeadlines {
+		return p.wrapErr("SetDeadline", os.ErrNoDeadline)
+	}
+	return p.wrapErr("SetDeadline", p.f.SetDeadline(t))
+}
+
+// SetReadDeadline sets the deadline for pending and future reads with
+// net.Conn semantics. It requires a port opened with UseDeadlines and
+// is an alternative to the VTIME timeout mode: leave ReadTimeout at zero,
+// otherwise every Read replaces the deadline.
+func (p *BasePort) SetReadDeadline(t time.Time) error {
+	if !p.cfg.UseDeadlines {
+		return p.wrapErr("SetReadDeadline", os.ErrNoDeadline)
+	}
+	return p.wrapErr("SetReadDeadline", p.f.SetReadDeadline(t))
+}
+
+// SetWriteDeadline sets the deadline for pending and future writes.
+// It requires a port opened with UseDeadlines.
+func (p *BasePort) SetWriteDeadline(t time.Time) error {
+	if !p.cfg.UseDeadlines {
+		return p.wrapErr("SetWriteDeadline", os.ErrNoDeadline)
+	}
+	return p.wrapErr("SetWriteDeadline", p.f.SetWriteDeadline(t))
+}
+
+// capture writes data to the capture file for its direction, a capture
+// failing is logged and stopped
+func (p *BasePort) capture(tag rune, data []byte) {
+	f := &p.rxCapture
+	if tag == '-' {
+		f = &p.txCapture
+	}
+	if *f == nil {
+		return
+	}
+	if _, err := (*f).Write(data); err != nil {
+		p.logMsg("Capture", "Error %s", err)
+		(*f).Close()
+		*f = nil
+	}
+}
+
 func (p *BasePort) Close() (err error) {
+	p.closed.Store(true)
 	p.logFlush()
 	p.logMsg("Close", "")
+	for _, f := range []*os.File{p.rxCapture, p.txCapture} {
+		if f != nil {
+			f.Close()
+		}
+	}
 	return p.f.Close()
 }
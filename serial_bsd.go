@@ -0,0 +1,387 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+// +build !cgo
+
+package serial
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pure syscall backend for the BSDs and macOS, used when cgo is not
+// available. The cgo backend in serial_posix.go is preferred otherwise.
+
+var standardBauds = []int{
+	Baud50, Baud75, Baud110, Baud134, Baud150, Baud200, Baud300, Baud600,
+	Baud1200, Baud1800, Baud2400, Baud4800, Baud9600, Baud19200, Baud38400,
+	Baud57600, Baud115200, Baud230400,
+}
+
+// BaudConstant returns the termios B* value for baud and whether it is a
+// standard rate. The BSDs define B* as the rate itself.
+func BaudConstant(baud int) (uint32, bool) {
+	for _, b := range standardBauds {
+		if b == baud {
+			return uint32(baud), true
+		}
+	}
+	return 0, false
+}
+
+func openPort(c *Config) (p *Port, err error) {
+	f, err := os.OpenFile(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if c.InheritFD {
+		if err = inheritFD(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return newPort(f, c)
+}
+
+// openFD opens the port on a descriptor obtained elsewhere
+func openFD(fd uintptr, c *Config) (*Port, error) {
+	// like O_NONBLOCK above, so that NewFile puts it into the poller
+	if err := syscall.SetNonblock(int(fd), true); err != nil {
+		syscall.Close(int(fd))
+		return nil, err
+	}
+	return newPort(os.NewFile(fd, c.Name), c)
+}
+
+// newPort configures the port on f, which it closes on failure
+func newPort(f *os.File, c *Config) (p *Port, err error) {
+	defer func() {
+		if err != nil && f != nil {
+			f.Close()
+		}
+	}()
+
+	if c.UseDeadlines || c.KeepNonBlock {
+		return nil, SerialError{Msg: "UseDeadlines and KeepNonBlock unsupported"}
+	}
+	port := &Port{BasePort{f: f, dev: realDevice(f.Name())}}
+
+	// fails with ENOTTY if the file is not a tty
+	if err = port.applyConfig(c); err != nil {
+		return nil, err
+	}
+
+	// see newPort in serial_linux.go
+	if err = syscall.SetNonblock(int(f.Fd()), false); err != nil {
+		return
+	}
+
+	return port, nil
+}
+
+// applyConfig validates c and sets the termios attributes accordingly
+func (p *Port) applyConfig(c *Config) error {
+	bits, err := c.dataBits()
+	if err != nil {
+		return err
+	}
+	cstopb, err := termiosStopBits(c, bits)
+	if err != nil {
+		return err
+	}
+	if err = checkFlowControl(c); err != nil {
+		return err
+	}
+
+	var t *unix.Termios
+	err = p.control(func(fd uintptr) (err error) {
+		t, err = unix.IoctlGetTermios(int(fd), unix.TIOCGETA)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	// the field types differ between systems, the constants fit them all
+	switch c.Baud {
+	case 50:
+		t.Ispeed = unix.B50
+	case 75:
+		t.Ispeed = unix.B75
+	case 110:
+		t.Ispeed = unix.B110
+	case 134:
+		t.Ispeed = unix.B134
+	case 150:
+		t.Ispeed = unix.B150
+	case 200:
+		t.Ispeed = unix.B200
+	case 300:
+		t.Ispeed = unix.B300
+	case 600:
+		t.Ispeed = unix.B600
+	case 1200:
+		t.Ispeed = unix.B1200
+	case 1800:
+		t.Ispeed = unix.B1800
+	case 2400:
+		t.Ispeed = unix.B2400
+	case 4800:
+		t.Ispeed = unix.B4800
+	case 9600:
+		t.Ispeed = unix.B9600
+	case 19200:
+		t.Ispeed = unix.B19200
+	case 38400:
+		t.Ispeed = unix.B38400
+	case 57600:
+		t.Ispeed = unix.B57600
+	case 115200:
+		t.Ispeed = unix.B115200
+	case 230400:
+		t.Ispeed = unix.B230400
+	default:
+		return SerialError{Msg: "Invalid baud rate", Cod: c.Baud}
+	}
+	t.Ospeed = t.Ispeed
+
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS
+	t.Cflag |= unix.CREAD | unix.CLOCAL
+	switch bits {
+	case 5:
+		t.Cflag |= unix.CS5
+	case 6:
+		t.Cflag |= unix.CS6
+	case 7:
+		t.Cflag |= unix.CS7
+	default:
+		t.Cflag |= unix.CS8
+	}
+	switch c.Parity {
+	case 0, ParityNone:
+	case ParityOdd:
+		t.Cflag |= unix.PARENB | unix.PARODD
+	case ParityEven:
+		t.Cflag |= unix.PARENB
+	default:
+		// no mark / space parity
+		return SerialError{Msg: "Unsupported parity", Cod: int(c.Parity)}
+	}
+	if cstopb {
+		t.Cflag |= unix.CSTOPB
+	}
+	if c.DisableReceiver {
+		t.Cflag &^= unix.CREAD
+	}
+	if c.FlowControl == FlowRTSCTS {
+		t.Cflag |= unix.CRTSCTS
+	}
+
+	t.Lflag &^= unix.ICANON | unix.ECHO | unix.ECHOE | unix.ECHONL | unix.ISIG
+	if c.Canonical {
+		t.Lflag |= unix.ICANON
+	}
+	if c.Echo {
+		t.Lflag |= unix.ECHO | unix.ECHOE
+	}
+
+	t.Iflag &^= unix.IXON | unix.IXOFF | unix.IXANY
+	if c.FlowControl == FlowXONXOFF {
+		t.Iflag |= unix.IXON | unix.IXOFF
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL
+	t.Iflag |= unix.IGNPAR
+	if c.DetectBreak {
+		t.Iflag |= unix.PARMRK
+	}
+	if c.MarkParityErrors {
+		t.Iflag &^= unix.IGNPAR
+		t.Iflag |= unix.PARMRK | unix.INPCK
+	}
+	if bits == 7 {
+		t.Iflag |= unix.ISTRIP
+	}
+
+	t.Oflag &^= unix.OPOST | unix.ONLCR
+	if c.CRLFTranslate {
+		t.Oflag |= unix.OPOST | unix.ONLCR
+		t.Iflag |= unix.ICRNL
+	}
+
+	vmin, vtime := posixTimeoutValues(c)
+	t.Cc[unix.VMIN] = vmin
+	t.Cc[unix.VTIME] = vtime
+
+	return p.control(func(fd uintptr) error {
+		return unix.IoctlSetTermios(int(fd), unix.TIOCSETA, t)
+	})
+}
+
+// wakeReader does nothing, the driver doesn't give up a blocked read
+// when the port switches to non-blocking mode like Linux does
+func (p *Port) wakeReader() {}
+
+// HangUp sets the speed to B0 for a moment, which drops DTR and makes
+// a modem hang up, then restores the previous settings
+func (p *Port) HangUp() (err error) {
+	defer func() { err = p.wrapErr("HangUp", err) }()
+	// the temporary settings must not apply to a concurrent read
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	var t *unix.Termios
+	err = p.control(func(fd uintptr) (err error) {
+		t, err = unix.IoctlGetTermios(int(fd), unix.TIOCGETA)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	hup := *t
+	hup.Ispeed = unix.B0
+	hup.Ospeed = unix.B0
+	err = p.control(func(fd uintptr) error {
+		return unix.IoctlSetTermios(int(fd), unix.TIOCSETA, &hup)
+	})
+	if err != nil {
+		p.logMsg("HangUp", "Error %s", err)
+		return err
+	}
+	p.logControl("HangUp", "")
+	time.Sleep(hangUpTime)
+	return p.control(func(fd uintptr) error {
+		return unix.IoctlSetTermios(int(fd), unix.TIOCSETA, t)
+	})
+}
+
+// inQueue returns the number of bytes in the input queue of the driver
+func (p *Port) inQueue() (n int, err error) {
+	// _IOR('f', 127, int) on all BSDs, x/sys/unix lacks it
+	const FIONREAD = 0x4004667f
+	err = p.control(func(fd uintptr) (err error) {
+		n, err = unix.IoctlGetInt(int(fd), FIONREAD)
+		return
+	})
+	return
+}
+
+// setOutput suspends or resumes output, tcflow uses the same ioctls
+func (p *Port) setOutput(on bool) error {
+	var req uint = unix.TIOCSTOP
+	if on {
+		req = unix.TIOCSTART
+	}
+	err := p.ioctl(req, 0)
+	if err != nil {
+		p.logMsg("Output", "%t -> error %s", on, err)
+		return err
+	}
+	p.logControl("Output", "%t", on)
+	return nil
+}
+
+// drain waits until the written data is transmitted, wl must be held
+func (p *Port) drain() error {
+	err := p.control(func(fd uintptr) error {
+		return unix.IoctlSetInt(int(fd), unix.TIOCDRAIN, 0)
+	})
+	if err != nil {
+		p.logMsg("Drain", "Error %s", err)
+	}
+	return err
+}
+
+// flush is FlushWith without the error wrapping
+func (p *Port) flush(flags FlushFlags) error {
+	p.dropPending(flags)
+	queue, ok := tcflushQueue(flags)
+	if !ok {
+		return nil
+	}
+	// the TC*FLUSH values match the FREAD / FWRITE bits TIOCFLUSH takes
+	err := p.control(func(fd uintptr) error {
+		return unix.IoctlSetPointerInt(int(fd), unix.TIOCFLUSH, queue)
+	})
+	if err != nil {
+		p.logMsg("Flush", "Error %s", err)
+		return err
+	}
+	p.logMsg("Flush", "")
+	return nil
+}
+
+// Select waits until at least one of the ports has data to read and
+// returns the ready ones. A negative timeout waits forever, zero only
+// checks the current state. On timeout the result is empty.
+func Select(ports []*Port, timeout time.Duration) ([]*Port, error) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	fds := make([]unix.PollFd, len(ports))
+	for i, p := range ports {
+		if err := p.pollFd(&fds[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range ports {
+		if p.pendingReady() {
+			// the held back input is there already, see DetectBreak
+			timeout = 0
+			break
+		}
+	}
+	if err := pollFds(fds, timeout); err != nil {
+		return nil, err
+	}
+	var ready []*Port
+	for i, p := range ports {
+		// errors and hangups are reported as ready, Read returns them
+		if fds[i].Revents != 0 || p.pendingReady() {
+			ready = append(ready, p)
+		}
+	}
+	return ready, nil
+}
+
+// poll waits until the port has data to read, like Select for one port
+func (p *Port) poll(timeout time.Duration) (bool, error) {
+	var fds [1]unix.PollFd
+	if err := p.pollFd(&fds[0]); err != nil {
+		return false, err
+	}
+	err := pollFds(fds[:], timeout)
+	return err == nil && fds[0].Revents != 0, err
+}
+
+// pollFd sets fd to wait for input on the port
+func (p *Port) pollFd(fd *unix.PollFd) error {
+	return p.control(func(h uintptr) error {
+		*fd = unix.PollFd{Fd: int32(h), Events: unix.POLLIN}
+		return nil
+	})
+}
+
+// pollFds waits with poll until one of fds is ready or timeout passed
+func pollFds(fds []unix.PollFd, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ms := -1
+		if timeout >= 0 {
+			// round up, poll takes milliseconds; a retry after EINTR
+			// waits only for the rest of timeout
+			rest := time.Until(deadline)
+			if rest < 0 {
+				rest = 0
+			}
+			ms = int((rest + time.Millisecond - 1) / time.Millisecond)
+		}
+		_, err := unix.Poll(fds, ms)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
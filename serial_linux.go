@@ -4,130 +4,670 @@
 package serial
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
-func openPort(c *Config) (p *Port, err error) {
-	var bauds = map[int]uint32{
-		50:      syscall.B50,
-		75:      syscall.B75,
-		110:     syscall.B110,
-		134:     syscall.B134,
-		150:     syscall.B150,
-		200:     syscall.B200,
-		300:     syscall.B300,
-		600:     syscall.B600,
-		1200:    syscall.B1200,
-		1800:    syscall.B1800,
-		2400:    syscall.B2400,
-		4800:    syscall.B4800,
-		9600:    syscall.B9600,
-		19200:   syscall.B19200,
-		38400:   syscall.B38400,
-		57600:   syscall.B57600,
-		115200:  syscall.B115200,
-		230400:  syscall.B230400,
-		460800:  syscall.B460800,
-		500000:  syscall.B500000,
-		576000:  syscall.B576000,
-		921600:  syscall.B921600,
-		1000000: syscall.B1000000,
-		1152000: syscall.B1152000,
-		1500000: syscall.B1500000,
-		2000000: syscall.B2000000,
-		2500000: syscall.B2500000,
-		3000000: syscall.B3000000,
-		3500000: syscall.B3500000,
-		4000000: syscall.B4000000,
-	}
-	rate := bauds[c.Baud]
-	if rate == 0 {
-		return nil, SerialError{Msg: "Invalid baud rate", Cod: c.Baud}
+var bauds = map[int]uint32{
+	50:      syscall.B50,
+	75:      syscall.B75,
+	110:     syscall.B110,
+	134:     syscall.B134,
+	150:     syscall.B150,
+	200:     syscall.B200,
+	300:     syscall.B300,
+	600:     syscall.B600,
+	1200:    syscall.B1200,
+	1800:    syscall.B1800,
+	2400:    syscall.B2400,
+	4800:    syscall.B4800,
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	500000:  syscall.B500000,
+	576000:  syscall.B576000,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+	1152000: syscall.B1152000,
+	1500000: syscall.B1500000,
+	2000000: syscall.B2000000,
+	2500000: syscall.B2500000,
+	3000000: syscall.B3000000,
+	3500000: syscall.B3500000,
+	4000000: syscall.B4000000,
+}
+
+// BaudConstant returns the termios B* value for baud and whether it is
+// a standard rate. Other rates are set through BOTHER and termios2.
+func BaudConstant(baud int) (uint32, bool) {
+	b, ok := bauds[baud]
+	return b, ok
+}
+
+var standardBauds = func() []int {
+	var r []int
+	for baud := range bauds {
+		r = append(r, baud)
 	}
+	sort.Ints(r)
+	return r
+}()
 
+func openPort(c *Config) (p *Port, err error) {
 	//	f, err := os.OpenFile(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0666)
-	f, err := os.OpenFile(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0666)
+	f, err := os.OpenFile(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0666)
 	if err != nil {
 		return nil, err
 	}
+	if c.InheritFD {
+		if err = inheritFD(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return newPort(f, c)
+}
 
+// openFD opens the port on a descriptor obtained elsewhere
+func openFD(fd uintptr, c *Config) (*Port, error) {
+	// like O_NONBLOCK above, so that NewFile puts it into the poller
+	if err := syscall.SetNonblock(int(fd), true); err != nil {
+		syscall.Close(int(fd))
+		return nil, err
+	}
+	name := c.Name
+	if name == "" {
+		// resolves to the device for the sysfs lookups
+		name = "/proc/self/fd/" + strconv.Itoa(int(fd))
+	}
+	return newPort(os.NewFile(fd, name), c)
+}
+
+// newPort configures the port on f, which it closes on failure
+func newPort(f *os.File, c *Config) (p *Port, err error) {
 	defer func() {
 		if err != nil && f != nil {
 			f.Close()
 		}
 	}()
 
-	fd := f.Fd()
+	port := &Port{BasePort{f: f, dev: realDevice(f.Name())}}
+
+	if err = port.applyConfig(c); err != nil {
+		return nil, err
+	}
+
+	if c.RxFIFOTrigger > 0 {
+		if err = port.setRxFIFOTrigger(c.RxFIFOTrigger); err != nil {
+			return nil, err
+		}
+	}
+
+	// With deadlines the file stays in the runtime poller, otherwise
+	// Fd switches it to blocking mode: VMIN / VTIME only apply then.
+	if !c.UseDeadlines && !c.KeepNonBlock {
+		if err = syscall.SetNonblock(int(f.Fd()), false); err != nil {
+			return
+		}
+	}
+
+	return port, nil
+}
+
+// applyConfig validates c and sets the termios attributes accordingly
+func (p *Port) applyConfig(c *Config) error {
+	if c.Baud <= 0 {
+		return SerialError{Msg: "Invalid baud rate", Cod: c.Baud}
+	}
+	rate, ok := BaudConstant(c.Baud)
+	if !ok {
+		// the speed is in the termios2 fields
+		rate = unix.BOTHER
+	}
+	bits, err := c.dataBits()
+	if err != nil {
+		return err
+	}
+	cstopb, err := termiosStopBits(c, bits)
+	if err != nil {
+		return err
+	}
+	if err = checkFlowControl(c); err != nil {
+		return err
+	}
+	csize := map[int]uint32{5: syscall.CS5, 6: syscall.CS6, 7: syscall.CS7, 8: syscall.CS8}[bits]
+
+	// #define CMSPAR 010000000000 /* mark or space (stick) parity */
+	const CMSPAR = 010000000000
+	var parity uint32
+	switch c.Parity {
+	case 0, ParityNone:
+	case ParityOdd:
+		parity = syscall.PARENB | syscall.PARODD
+	case ParityEven:
+		parity = syscall.PARENB
+	case ParityMark:
+		parity = syscall.PARENB | syscall.PARODD | CMSPAR
+	case ParitySpace:
+		parity = syscall.PARENB | CMSPAR
+	default:
+		return SerialError{Msg: "Unsupported parity", Cod: int(c.Parity)}
+	}
 
 	// Get current port settings
 	var ps syscall.Termios
-	_, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(fd),
-		uintptr(syscall.TCGETS),
-		uintptr(unsafe.Pointer(&ps)),
-	)
-	if errno != 0 {
-		return nil, errno
+	if err = p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps)); err != nil {
+		return err
 	}
 
 	// #define CRTSCTS 020000000000 /* Flow control. */
 	CRTSCTS := 020000000000
-	ps.Cflag &= ^uint32(syscall.PARENB | syscall.CSIZE | syscall.CSTOPB | CRTSCTS)
-	ps.Cflag |= (syscall.CREAD | syscall.CLOCAL | syscall.CS8)
-	if c.StopBits > 1 {
+	ps.Cflag &= ^uint32(syscall.PARENB | syscall.PARODD | CMSPAR | syscall.CSIZE | syscall.CSTOPB | CRTSCTS)
+	ps.Cflag |= (syscall.CREAD | syscall.CLOCAL | csize | parity)
+	if cstopb {
 		ps.Cflag |= syscall.CSTOPB
 	}
+	if c.DisableReceiver {
+		ps.Cflag &= ^uint32(syscall.CREAD)
+	}
+	if c.FlowControl == FlowRTSCTS {
+		ps.Cflag |= uint32(CRTSCTS)
+	}
 
 	ps.Lflag &= ^uint32(syscall.ICANON | syscall.ECHO | syscall.ECHOE | syscall.ECHONL | syscall.ISIG)
+	if c.Canonical {
+		ps.Lflag |= syscall.ICANON
+	}
+	if c.Echo {
+		ps.Lflag |= syscall.ECHO | syscall.ECHOE
+	}
 
 	ps.Iflag &= ^uint32(syscall.IXON | syscall.IXOFF | syscall.IXANY)
+	if c.FlowControl == FlowXONXOFF {
+		ps.Iflag |= syscall.IXON | syscall.IXOFF
+	}
 	ps.Iflag &= ^uint32(syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL)
 	ps.Iflag |= syscall.IGNPAR
+	if c.DetectBreak {
+		ps.Iflag |= syscall.PARMRK
+	}
+	if c.MarkParityErrors {
+		ps.Iflag &^= syscall.IGNPAR
+		ps.Iflag |= syscall.PARMRK | syscall.INPCK
+	}
+	if bits == 7 {
+		// keep a parity bit the driver passes through out of the data
+		ps.Iflag |= syscall.ISTRIP
+	}
 
 	ps.Oflag &= ^uint32(syscall.OPOST | syscall.ONLCR)
+	if c.CRLFTranslate {
+		ps.Oflag |= syscall.OPOST | syscall.ONLCR
+		ps.Iflag |= syscall.ICRNL
+	}
 
-	vmin, vtime := posixTimeoutValues(c.ReadTimeout)
+	vmin, vtime := posixTimeoutValues(c)
 	ps.Cc[syscall.VMIN] = vmin
 	ps.Cc[syscall.VTIME] = vtime
 
-	ps.Ispeed = rate
-	ps.Ospeed = rate
+	// the kernel takes the speed from CBAUD, Ispeed / Ospeed are libc's
+	ps.Cflag &^= unix.CBAUD
+	ps.Cflag |= rate
+	if rate != unix.BOTHER {
+		ps.Ispeed = rate
+		ps.Ospeed = rate
+		return p.ioctlPtr(syscall.TCSETS, unsafe.Pointer(&ps))
+	}
+
+	// a rate without a Bxxx constant, like 45 baud for teletypes
+	t2 := unix.Termios{
+		Iflag:  ps.Iflag,
+		Oflag:  ps.Oflag,
+		Cflag:  ps.Cflag,
+		Lflag:  ps.Lflag,
+		Line:   ps.Line,
+		Ispeed: uint32(c.Baud),
+		Ospeed: uint32(c.Baud),
+	}
+	copy(t2.Cc[:], ps.Cc[:])
+	return p.ioctlPtr(tcsets2, unsafe.Pointer(&t2))
+}
+
+// wakeReader makes a Read blocked in the driver return, as Close would
+// wait for it otherwise. With O_NONBLOCK set the read fails with EAGAIN
+// and waits in the runtime poller, which Close wakes. Setting the
+// attributes again wakes up the readers of the tty.
+func (p *Port) wakeReader() {
+	p.control(func(fd uintptr) error {
+		return syscall.SetNonblock(int(fd), true)
+	})
+	var ps syscall.Termios
+	if p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps)) == nil {
+		p.ioctlPtr(syscall.TCSETS, unsafe.Pointer(&ps))
+	}
+}
+
+// HangUp sets the speed to B0 for a moment, which drops DTR and makes
+// a modem hang up, then restores the previous settings
+func (p *Port) HangUp() (err error) {
+	defer func() { err = p.wrapErr("HangUp", err) }()
+	// the temporary settings must not apply to a concurrent read
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	var ps syscall.Termios
+	if err := p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps)); err != nil {
+		return err
+	}
+	hup := ps
+	hup.Cflag &^= unix.CBAUD
+	hup.Ispeed = syscall.B0
+	hup.Ospeed = syscall.B0
+	if err := p.ioctlPtr(syscall.TCSETS, unsafe.Pointer(&hup)); err != nil {
+		p.logMsg("HangUp", "Error %s", err)
+		return err
+	}
+	p.logControl("HangUp", "")
+	time.Sleep(hangUpTime)
+	return p.ioctlPtr(syscall.TCSETS, unsafe.Pointer(&ps))
+}
+
+// serialStruct is struct serial_struct of linux/serial.h
+type serialStruct struct {
+	typ           int32
+	line          int32
+	port          uint32
+	irq           int32
+	flags         int32
+	xmitFifoSize  int32
+	customDivisor int32
+	baudBase      int32
+	closeDelay    uint16
+	ioType        byte
+	reservedChar  byte
+	hub6          int32
+	closingWait   uint16
+	closingWait2  uint16
+	iomemBase     uintptr
+	iomemRegShift uint16
+	portHigh      uint32
+	iomapBase     uintptr
+}
+
+// setRxFIFOTrigger sets the receive FIFO trigger level of the UART
+// through sysfs, the 8250 driver has no ioctl for it, and sets the
+// low latency flag with TIOCSSERIAL.
+func (p *Port) setRxFIFOTrigger(level int) error {
+	const ASYNC_LOW_LATENCY = 1 << 13
+	var ss serialStruct
+	if err := p.ioctlPtr(syscall.TIOCGSERIAL, unsafe.Pointer(&ss)); err != nil {
+		return SerialError{Msg: "No UART settings", Err: err}
+	}
+	ss.flags |= ASYNC_LOW_LATENCY
+	if err := p.ioctlPtr(syscall.TIOCSSERIAL, unsafe.Pointer(&ss)); err != nil {
+		return SerialError{Msg: "No UART settings", Err: err}
+	}
 
-	_, _, errno = syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(fd),
-		uintptr(syscall.TCSETS),
-		uintptr(unsafe.Pointer(&ps)),
-	)
-	if errno != 0 {
-		return nil, errno
+	attr := filepath.Join("/sys/class/tty", filepath.Base(p.dev), "rx_trig_bytes")
+	if err := os.WriteFile(attr, []byte(strconv.Itoa(level)), 0); err != nil {
+		return SerialError{Msg: "Unsupported RX FIFO trigger", Cod: level, Err: err}
 	}
+	return nil
+}
 
-	if err = syscall.SetNonblock(int(fd), true); err != nil {
-		return
+// ActualBaud returns the baud rate the port really runs at. For a UART
+// it is derived from the clock divisor, which can't hit every rate
+// exactly, otherwise it is the rate the driver reports.
+func (p *Port) ActualBaud() (_ int, err error) {
+	defer func() { err = p.wrapErr("ActualBaud", err) }()
+	const ASYNC_SPD_MASK, ASYNC_SPD_CUST = 0x1030, 0x0030
+	var t2 unix.Termios
+	if err := p.ioctlPtr(tcgets2, unsafe.Pointer(&t2)); err != nil {
+		return 0, err
 	}
+	baud := int(t2.Ospeed)
 
-	return &Port{BasePort{f: f}}, nil
+	var ss serialStruct
+	if err := p.ioctlPtr(syscall.TIOCGSERIAL, unsafe.Pointer(&ss)); err != nil || ss.baudBase <= 0 || baud <= 0 {
+		// not a UART, e.g. a USB adapter
+		return baud, nil
+	}
+	base := int(ss.baudBase)
+	div := int(ss.customDivisor)
+	if ss.flags&ASYNC_SPD_MASK != ASYNC_SPD_CUST || div <= 0 {
+		div = (base + baud/2) / baud
+		if div < 1 {
+			div = 1
+		}
+	}
+	return base / div, nil
 }
 
-// Discards data written to the port but not transmitted,
-// or data received but not read
-func (p *Port) Flush() error {
+// serialIcounter is struct serial_icounter_struct of linux/serial.h
+type serialIcounter struct {
+	cts, dsr, rng, dcd int32
+	rx, tx             int32
+	frame, overrun     int32
+	parity, brk        int32
+	bufOverrun         int32
+	reserved           [9]int32
+}
+
+// LineCounters holds the input event counts the driver keeps for a
+// port. The counts wrap around.
+type LineCounters struct {
+	// modem line transitions
+	CTS, DSR, RI, DCD uint32
+	// bytes received and transmitted
+	Rx, Tx uint32
+	// receive errors
+	Frame, Overrun, Parity, Break uint32
+	// bytes lost because the tty buffer was full
+	BufOverrun uint32
+}
+
+// LineCounters returns the counters of the port, see TIOCGICOUNT.
+// They start when the driver sets up the port.
+func (p *Port) LineCounters() (LineCounters, error) {
+	lc, err := p.lineCounters()
+	return lc, p.wrapErr("LineCounters", err)
+}
+
+func (p *Port) lineCounters() (LineCounters, error) {
+	var ic serialIcounter
+	if err := p.ioctlPtr(unix.TIOCGICOUNT, unsafe.Pointer(&ic)); err != nil {
+		return LineCounters{}, err
+	}
+	return LineCounters{
+		CTS:        uint32(ic.cts),
+		DSR:        uint32(ic.dsr),
+		RI:         uint32(ic.rng),
+		DCD:        uint32(ic.dcd),
+		Rx:         uint32(ic.rx),
+		Tx:         uint32(ic.tx),
+		Frame:      uint32(ic.frame),
+		Overrun:    uint32(ic.overrun),
+		Parity:     uint32(ic.parity),
+		Break:      uint32(ic.brk),
+		BufOverrun: uint32(ic.bufOverrun),
+	}, nil
+}
+
+// InputOverruns returns how many received bytes the driver lost,
+// counting UART FIFO and tty buffer overruns.
+func (p *Port) InputOverruns() (uint32, error) {
+	lc, err := p.lineCounters()
+	if err != nil {
+		return 0, p.wrapErr("InputOverruns", err)
+	}
+	return lc.Overrun + lc.BufOverrun, nil
+}
+
+// inQueue returns the number of bytes in the input queue of the driver
+func (p *Port) inQueue() (int, error) {
+	var n int32
+	err := p.ioctlPtr(syscall.TIOCINQ, unsafe.Pointer(&n))
+	return int(n), err
+}
+
+// setOutput suspends or resumes output like tcflow
+func (p *Port) setOutput(on bool) error {
+	var action uintptr = unix.TCOOFF
+	if on {
+		action = unix.TCOON
+	}
+	err := p.ioctl(unix.TCXONC, action)
+	if err != nil {
+		p.logMsg("Output", "%t -> error %s", on, err)
+		return err
+	}
+	p.logControl("Output", "%t", on)
+	return nil
+}
+
+// drain waits until the written data is transmitted, wl must be held
+func (p *Port) drain() error {
+	// tcdrain is TCSBRK with a non-zero argument
+	err := p.ioctl(unix.TCSBRK, 1)
+	if err != nil {
+		p.logMsg("Drain", "Error %s", err)
+	}
+	return err
+}
+
+// flush is FlushWith without the error wrapping
+func (p *Port) flush(flags FlushFlags) error {
 	const TCFLSH = 0x540B
-	_, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(p.f.Fd()),
-		uintptr(TCFLSH),
-		uintptr(syscall.TCIOFLUSH),
-	)
-	if errno != 0 {
-		p.logMsg("Flush", "Error %d", errno)
-		return errno
+	p.dropPending(flags)
+	queue, ok := tcflushQueue(flags)
+	if !ok {
+		return nil
+	}
+	err := p.ioctl(TCFLSH, uintptr(queue))
+	if err != nil {
+		p.logMsg("Flush", "Error %s", err)
+		return err
 	} else {
 		p.logMsg("Flush", "")
 		return nil
 	}
 }
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// Select waits until at least one of the ports has data to read and
+// returns the ready ones. A negative timeout waits forever, zero only
+// checks the current state. On timeout the result is empty.
+func Select(ports []*Port, timeout time.Duration) ([]*Port, error) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	fds := make([]pollFd, len(ports))
+	for i, p := range ports {
+		if err := p.pollFd(&fds[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range ports {
+		if p.pendingReady() {
+			// the held back input is there already, see DetectBreak
+			timeout = 0
+			break
+		}
+	}
+	if err := pollFds(fds, timeout); err != nil {
+		return nil, err
+	}
+	var ready []*Port
+	for i, p := range ports {
+		// errors and hangups are reported as ready, Read returns them
+		if fds[i].revents != 0 || p.pendingReady() {
+			ready = append(ready, p)
+		}
+	}
+	return ready, nil
+}
+
+// poll waits until the port has data to read, like Select for one port
+func (p *Port) poll(timeout time.Duration) (bool, error) {
+	var fds [1]pollFd
+	if err := p.pollFd(&fds[0]); err != nil {
+		return false, err
+	}
+	err := pollFds(fds[:], timeout)
+	return err == nil && fds[0].revents != 0, err
+}
+
+// pollFd sets fd to wait for input on the port
+func (p *Port) pollFd(fd *pollFd) error {
+	const POLLIN = 0x0001
+	return p.control(func(h uintptr) error {
+		*fd = pollFd{fd: int32(h), events: POLLIN}
+		return nil
+	})
+}
+
+// pollFds waits with ppoll until one of fds is ready or timeout passed
+func pollFds(fds []pollFd, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var ts *syscall.Timespec
+		if timeout >= 0 {
+			// a retry after EINTR waits only for the rest of timeout
+			rest := time.Until(deadline)
+			if rest < 0 {
+				rest = 0
+			}
+			t := syscall.NsecToTimespec(int64(rest))
+			ts = &t
+		}
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_PPOLL,
+			uintptr(unsafe.Pointer(&fds[0])),
+			uintptr(len(fds)),
+			uintptr(unsafe.Pointer(ts)),
+			0, 0, 0,
+		)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// DeviceInfo returns the USB ids and strings of the device behind the
+// port from sysfs. For other devices only Name and, from the driver,
+// Product are set.
+func (p *Port) DeviceInfo() (_ PortInfo, err error) {
+	defer func() { err = p.wrapErr("DeviceInfo", err) }()
+	info := PortInfo{Name: p.dev}
+	dev, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(p.dev), "device"))
+	if err != nil {
+		return info, SerialError{Msg: "No device info", Err: err}
+	}
+	// the USB device is the first parent with an idVendor
+	for d := dev; d != "/" && d != "."; d = filepath.Dir(d) {
+		if vid := sysfsAttr(d, "idVendor"); vid != "" {
+			info.VID = vid
+			info.PID = sysfsAttr(d, "idProduct")
+			info.SerialNumber = sysfsAttr(d, "serial")
+			info.Manufacturer = sysfsAttr(d, "manufacturer")
+			info.Product = sysfsAttr(d, "product")
+			return info, nil
+		}
+	}
+	if drv, err := filepath.EvalSymlinks(filepath.Join(dev, "driver")); err == nil {
+		info.Product = filepath.Base(drv)
+	}
+	return info, nil
+}
+
+// sysfsAttr returns the value of a sysfs attribute, empty if missing
+func sysfsAttr(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// the name prefixes of serial devices in /dev
+var portPrefixes = []string{
+	"ttyS", "ttyUSB", "ttyACM", "ttyAMA", "ttyO", "ttymxc", "ttySAC", "ttyTHS", "ttyGS", "rfcomm",
+}
+
+// WatchPorts reports serial devices appearing in and disappearing from
+// /dev until the returned stop function is called, which closes the
+// channel. Devices present at the start are not reported.
+func WatchPorts() (<-chan PortEvent, func(), error) {
+	return watchDir("/dev")
+}
+
+// watchDir reports the serial device names created in and removed from
+// dir, using inotify
+func watchDir(dir string) (<-chan PortEvent, func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	const mask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+	if _, err = syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	// non-blocking, so that closing it ends a pending Read
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	events := make(chan PortEvent, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(events)
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+				off += syscall.SizeofInotifyEvent + int(ev.Len)
+				if i := bytes.IndexByte(name, 0); i >= 0 {
+					name = name[:i]
+				}
+				if !isPortName(string(name)) {
+					continue
+				}
+				pe := PortEvent{
+					Name:  filepath.Join(dir, string(name)),
+					Added: ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0,
+				}
+				select {
+				case events <- pe:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			f.Close()
+		})
+	}
+	return events, stop, nil
+}
+
+func isPortName(name string) bool {
+	for _, prefix := range portPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+// +build linux,ppc linux,ppc64 linux,ppc64le
+
+package serial
+
+import "golang.org/x/sys/unix"
+
+// powerpc has no termios2, its struct termios holds the speeds already
+const (
+	tcgets2 = unix.TCGETS
+	tcsets2 = unix.TCSETS
+)
@@ -0,0 +1,11 @@
+// +build linux,!ppc,!ppc64,!ppc64le
+
+package serial
+
+import "golang.org/x/sys/unix"
+
+// the ioctls for struct termios2, which holds the speeds for BOTHER
+const (
+	tcgets2 = unix.TCGETS2
+	tcsets2 = unix.TCSETS2
+)
@@ -0,0 +1,1325 @@
+// +build linux
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openPty opens a pseudo terminal pair, the master side plays the device
+func openPty(t *testing.T) (*os.File, string) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	var unlock int32
+	var n uint32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, m.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if errno == 0 {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, m.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	}
+	if errno != 0 {
+		t.Skip("no pty:", errno)
+	}
+	return m, "/dev/pts/" + strconv.Itoa(int(n))
+}
+
+func openTestPort(t *testing.T, c *Config) (*os.File, *Port) {
+	m, name := openPty(t)
+	c.Name = name
+	if c.Baud == 0 {
+		c.Baud = 9600
+	}
+	p, err := OpenPort(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return m, p
+}
+
+func TestReadTimeout(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond})
+
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); n != 0 || err != ErrTimeout {
+		t.Fatalf("Read = %d, %v; want 0, ErrTimeout", n, err)
+	}
+
+	m.Write([]byte("hi"))
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("Read = %q, %v; want \"hi\"", buf[:n], err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 30 * time.Millisecond, UseDeadlines: true})
+
+	buf := make([]byte, 16)
+	start := time.Now()
+	if _, err := p.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read error = %v; want os.ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Read took %v", d)
+	}
+
+	m.Write([]byte("hi"))
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("Read = %q, %v; want \"hi\"", buf[:n], err)
+	}
+}
+
+func TestSetReadDeadline(t *testing.T) {
+	_, p := openTestPort(t, &Config{UseDeadlines: true})
+
+	p.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+	if _, err := p.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read error = %v; want os.ErrDeadlineExceeded", err)
+	}
+
+	_, q := openTestPort(t, &Config{})
+	if err := q.SetReadDeadline(time.Now()); err != os.ErrNoDeadline {
+		t.Fatalf("SetReadDeadline = %v; want os.ErrNoDeadline", err)
+	}
+}
+
+func TestReadAtLeast(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 200 * time.Millisecond})
+
+	go func() {
+		m.Write([]byte("ab"))
+		time.Sleep(20 * time.Millisecond)
+		m.Write([]byte("cd"))
+	}()
+	buf := make([]byte, 16)
+	n, err := p.ReadAtLeast(buf, 4)
+	if err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("ReadAtLeast = %q, %v; want \"abcd\"", buf[:n], err)
+	}
+
+	m.Write([]byte("ef"))
+	n, err = p.ReadAtLeast(buf, 4)
+	if err != ErrTimeout || string(buf[:n]) != "ef" {
+		t.Fatalf("ReadAtLeast = %q, %v; want \"ef\", ErrTimeout", buf[:n], err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	m.Write([]byte("stale"))
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := m.Read(buf)
+		if string(buf[:n]) == "ping\n" {
+			m.Write([]byte("pong\nmore"))
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	resp, err := p.Transaction([]byte("ping\n"), '\n', time.Second)
+	if err != nil || string(resp) != "pong\n" {
+		t.Fatalf("Transaction = %q, %v; want \"pong\\n\"", resp, err)
+	}
+
+	resp, err = p.Transaction([]byte("x"), '\n', 50*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("Transaction = %q, %v; want ErrTimeout", resp, err)
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	_, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond})
+	p.cfg.WrapError = func(op string, err error) error {
+		return fmt.Errorf("%s %s: %w", p.Name(), op, err)
+	}
+
+	_, err := p.Read(make([]byte, 4))
+	if !errors.Is(err, ErrTimeout) || !strings.HasPrefix(err.Error(), p.Name()+" Read: ") {
+		t.Fatalf("Read = %v; want ErrTimeout wrapped with the port and op", err)
+	}
+	if _, err = p.ReadUntil('\n', 0); !strings.Contains(err.Error(), " ReadUntil: ") {
+		t.Fatalf("ReadUntil = %v; want it wrapped", err)
+	}
+
+	// each method wraps once, with its own name
+	buf := make([]byte, 4)
+	for op, call := range map[string]func() error{
+		"ReadRune":        func() error { _, _, err := p.ReadRune(); return err },
+		"ReadBurst":       func() error { _, err := p.ReadBurst(time.Millisecond, 0); return err },
+		"ReadAvailable":   func() error { _, err := p.ReadAvailable(buf); return err },
+		"Ping":            func() error { _, err := p.Ping([]byte("AT"), '\n', 50*time.Millisecond); return err },
+		"SetReadDeadline": func() error { return p.SetReadDeadline(time.Now()) },
+		"Probe":           func() error { _, err := p.Probe(); return err },
+	} {
+		err := call()
+		if want := p.Name() + " " + op + ": "; err == nil || !strings.HasPrefix(err.Error(), want) ||
+			strings.Count(err.Error(), p.Name()) != 1 {
+			t.Errorf("%s = %v; want it wrapped once as %q", op, err, want)
+		}
+	}
+
+	// the sticky error is wrapped like the write that got it
+	p.File().Close()
+	p.Write([]byte("x"))
+	if err := p.Err(); err == nil || !strings.HasPrefix(err.Error(), p.Name()+" Write: ") {
+		t.Errorf("Err = %v; want it wrapped as Write", err)
+	}
+	if err := p.FlushWith(FlushRx); err == nil || !strings.HasPrefix(err.Error(), p.Name()+" FlushWith: ") {
+		t.Errorf("FlushWith = %v; want it wrapped", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := m.Read(buf)
+		time.Sleep(50 * time.Millisecond)
+		m.Write(append(buf[:n:n], '\n'))
+	}()
+	d, err := p.Ping([]byte("AT"), '\n', time.Second)
+	if err != nil || d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("Ping = %v, %v; want about 50ms", d, err)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	echo := func(xor byte) {
+		buf := make([]byte, 16)
+		n, _ := m.Read(buf)
+		buf[n-1] ^= xor
+		m.Write(buf[:n])
+	}
+	go echo(0)
+	if err := p.Loopback([]byte("0123456789"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	go echo(1)
+	if err := p.Loopback([]byte("0123456789"), time.Second); err == nil {
+		t.Fatal("Loopback succeeded with a corrupted echo")
+	}
+	if err := p.Loopback([]byte("0123456789"), 50*time.Millisecond); err == nil {
+		t.Fatal("Loopback succeeded without an echo")
+	}
+}
+
+func TestStopBits1Half(t *testing.T) {
+	_, name := openPty(t)
+	_, err := OpenPort(&Config{Name: name, Baud: 9600, StopBits: StopBits1Half})
+	if err == nil {
+		t.Fatal("OpenPort accepted 1.5 stop bits")
+	}
+}
+
+func TestOpenError(t *testing.T) {
+	_, err := OpenPort(&Config{Name: "/dev/nonexistent-tty", Baud: 9600})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenPort error = %v; want os.ErrNotExist", err)
+	}
+	if !strings.Contains(err.Error(), "/dev/nonexistent-tty 9600 8N1") {
+		t.Fatalf("OpenPort error %q doesn't name the config", err)
+	}
+}
+
+func TestMode7E1Strip(t *testing.T) {
+	c := &Config{ReadTimeout: 100 * time.Millisecond}
+	c.SetMode7E1()
+	m, p := openTestPort(t, c)
+
+	m.Write([]byte{0xC1, 0x42})
+	buf := make([]byte, 16)
+	n, err := p.ReadAtLeast(buf, 2)
+	if err != nil || string(buf[:n]) != "AB" {
+		t.Fatalf("ReadAtLeast = %q, %v; want \"AB\"", buf[:n], err)
+	}
+}
+
+func TestDiscardUntilIdle(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond})
+
+	m.Write([]byte("boot chatter"))
+	if err := p.DiscardUntilIdle(50*time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); n != 0 || err != ErrTimeout {
+		t.Fatalf("Read after discard = %q, %v; want ErrTimeout", buf[:n], err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				m.Write([]byte("."))
+			}
+		}
+	}()
+	if err := p.DiscardUntilIdle(50*time.Millisecond, 200*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("DiscardUntilIdle on a busy line = %v; want ErrTimeout", err)
+	}
+}
+
+func TestMinBytes(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond, MinBytes: 3})
+
+	go func() {
+		m.Write([]byte("a"))
+		time.Sleep(20 * time.Millisecond)
+		m.Write([]byte("bc"))
+	}()
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "abc" {
+		t.Fatalf("Read = %q, %v; want \"abc\"", buf[:n], err)
+	}
+
+	// a short burst is returned once the line is idle
+	m.Write([]byte("de"))
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "de" {
+		t.Fatalf("Read = %q, %v; want \"de\"", buf[:n], err)
+	}
+}
+
+func TestOpenLogError(t *testing.T) {
+	m, name := openPty(t)
+	tx := t.TempDir() + "/tx.bin"
+	p, err := OpenPort(&Config{Name: name, Baud: 9600, LogFile: "/nonexistent/serial.log", RawCaptureTxFile: tx})
+	if p == nil {
+		t.Fatal("OpenPort failed:", err)
+	}
+	defer p.Close()
+	var se SerialError
+	if !errors.As(err, &se) || se.Tag != "Log" {
+		t.Fatalf("OpenPort error = %v; want a Log error", err)
+	}
+
+	p.Write([]byte("hi"))
+	buf := make([]byte, 16)
+	if n, err := m.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("Read = %q, %v; want \"hi\"", buf[:n], err)
+	}
+	// the capture is opened despite the log error
+	if b, err := os.ReadFile(tx); err != nil || string(b) != "hi" {
+		t.Fatalf("tx capture = %q, %v", b, err)
+	}
+}
+
+func TestRxFIFOTriggerUnsupported(t *testing.T) {
+	_, name := openPty(t)
+	p, err := OpenPort(&Config{Name: name, Baud: 9600, RxFIFOTrigger: 1})
+	if err == nil {
+		p.Close()
+		t.Fatal("OpenPort set a FIFO trigger on a pty")
+	}
+}
+
+func TestOpenSymlink(t *testing.T) {
+	_, name := openPty(t)
+	link := t.TempDir() + "/tty-by-id"
+	if err := os.Symlink(name, link); err != nil {
+		t.Fatal(err)
+	}
+	p, err := OpenPort(&Config{Name: link, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Name() != link || p.dev != name {
+		t.Fatalf("Name() = %q, dev = %q; want %q, %q", p.Name(), p.dev, link, name)
+	}
+}
+
+func TestWriteFrom(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadChunkSize: 4})
+
+	n, err := p.WriteFrom(strings.NewReader("hello, world"))
+	if n != 12 || err != nil {
+		t.Fatalf("WriteFrom = %d, %v; want 12", n, err)
+	}
+	buf := make([]byte, 16)
+	var got []byte
+	for len(got) < 12 {
+		k, err := m.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:k]...)
+	}
+	if string(got) != "hello, world" {
+		t.Fatalf("received %q", got)
+	}
+}
+
+func TestReadTo(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond})
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			m.Write([]byte("dump "))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	var sb strings.Builder
+	n, err := p.ReadTo(&sb, 100*time.Millisecond)
+	if err != nil || n != 15 || sb.String() != "dump dump dump " {
+		t.Fatalf("ReadTo = %d, %v, %q; want 15 bytes", n, err, sb.String())
+	}
+}
+
+func TestHangUp(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+
+	var before, after syscall.Termios
+	p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&before))
+	if err := p.HangUp(); err != nil {
+		t.Fatal(err)
+	}
+	p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&after))
+	if after.Cflag != before.Cflag {
+		t.Fatalf("Cflag %o after HangUp, was %o", after.Cflag, before.Cflag)
+	}
+}
+
+func TestSetBaud(t *testing.T) {
+	_, p := openTestPort(t, &Config{Baud: 9600})
+
+	const CBAUD = 0010017
+	speed := func() uint32 {
+		var ps syscall.Termios
+		p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps))
+		return ps.Cflag & CBAUD
+	}
+	if s := speed(); s != syscall.B9600 {
+		t.Fatalf("speed %o after open, want B9600", s)
+	}
+	if err := p.SetBaud(115200); err != nil {
+		t.Fatal(err)
+	}
+	if s := speed(); s != syscall.B115200 {
+		t.Fatalf("speed %o after SetBaud, want B115200", s)
+	}
+	if err := p.SetBaud(0); err == nil {
+		t.Fatal("SetBaud accepted 0")
+	}
+	if p.cfg.Baud != 115200 {
+		t.Fatalf("Baud %d after a failed SetBaud, want 115200", p.cfg.Baud)
+	}
+}
+
+func TestSetReadTimeout(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+
+	if err := p.SetReadTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); n != 0 || err != ErrTimeout {
+		t.Fatalf("Read = %d, %v; want 0, ErrTimeout", n, err)
+	}
+}
+
+func TestActualBaud(t *testing.T) {
+	_, p := openTestPort(t, &Config{Baud: 19200})
+
+	if baud, err := p.ActualBaud(); err != nil || baud != 19200 {
+		t.Fatalf("ActualBaud = %d, %v; want 19200", baud, err)
+	}
+}
+
+func TestBaudot(t *testing.T) {
+	_, p := openTestPort(t, &Config{Baud: 45, DataBits: 5, StopBits: StopBits1Half})
+
+	// a pty forces CS8, only CSTOPB can be checked
+	var ps syscall.Termios
+	p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps))
+	if ps.Cflag&syscall.CSTOPB == 0 {
+		t.Fatalf("Cflag %o, want CSTOPB", ps.Cflag)
+	}
+	if baud, err := p.ActualBaud(); err != nil || baud != 45 {
+		t.Fatalf("ActualBaud = %d, %v; want 45", baud, err)
+	}
+}
+
+func TestBufferedWriter(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	w := p.BufferedWriter(8)
+	for _, b := range []byte("frame") {
+		w.Write([]byte{b})
+	}
+	if w.Buffered() != 5 {
+		t.Fatalf("Buffered() = %d, want 5", w.Buffered())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := m.Read(buf); err != nil || string(buf[:n]) != "frame" {
+		t.Fatalf("Read = %q, %v; want \"frame\"", buf[:n], err)
+	}
+}
+
+func TestFlushAfterWrite(t *testing.T) {
+	m, p := openTestPort(t, &Config{FlushAfterWrite: true})
+
+	if n, err := p.Write([]byte("cmd")); n != 3 || err != nil {
+		t.Fatalf("Write = %d, %v; want 3", n, err)
+	}
+	if err := p.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := m.Read(buf); err != nil || string(buf[:n]) != "cmd" {
+		t.Fatalf("Read = %q, %v; want \"cmd\"", buf[:n], err)
+	}
+}
+
+func TestDetectBreak(t *testing.T) {
+	_, p := openTestPort(t, &Config{DetectBreak: true})
+
+	// a pty doesn't pass breaks, feed the marked stream directly
+	p.rxPend = []byte{'a', 0xFF, 0xFF, 0xFF, 0x00, 0x00, 'b', 0xFF}
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "a\xFF" {
+		t.Fatalf("Read = %q, %v; want \"a\\xFF\"", buf[:n], err)
+	}
+	if n, err := p.Read(buf); n != 0 || err != ErrBreak {
+		t.Fatalf("Read = %q, %v; want ErrBreak", buf[:n], err)
+	}
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "b" {
+		t.Fatalf("Read = %q, %v; want \"b\"", buf[:n], err)
+	}
+	if string(p.rxPend) != "\xFF" {
+		t.Fatalf("pending %q, want the incomplete mark", p.rxPend)
+	}
+}
+
+func TestSelectPending(t *testing.T) {
+	_, p := openTestPort(t, &Config{DetectBreak: true})
+	_, q := openTestPort(t, &Config{})
+
+	// data held back after a break is ready, though the driver has none
+	p.rxPend = []byte{0xFF, 0x00, 0x00, 'a'}
+	if _, err := p.Read(make([]byte, 16)); err != ErrBreak {
+		t.Fatalf("Read = %v; want ErrBreak", err)
+	}
+	start := time.Now()
+	ready, err := Select([]*Port{q, p}, time.Second)
+	if err != nil || len(ready) != 1 || ready[0] != p || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("Select = %v, %v after %v; want p at once", ready, err, time.Since(start))
+	}
+}
+
+func TestMarkParityErrors(t *testing.T) {
+	_, p := openTestPort(t, &Config{DetectBreak: true, MarkParityErrors: true})
+
+	// a pty has no parity, feed the marked stream directly
+	p.rxPend = []byte{0xFF, 0x00, 0x81, 'a', 0xFF, 0xFF, 0xFF, 0x00, 0x00}
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "\xFF\x00\x81a\xFF\xFF" {
+		t.Fatalf("Read = %q, %v; want the marks kept", buf[:n], err)
+	}
+	if n, err := p.Read(buf); n != 0 || err != ErrBreak {
+		t.Fatalf("Read = %q, %v; want ErrBreak", buf[:n], err)
+	}
+
+	p.rxPend = []byte{0xFF, 0x00, 0x81}
+	if n, err := p.Read(buf[:2]); err != io.ErrShortBuffer {
+		t.Fatalf("Read = %q, %v; want io.ErrShortBuffer", buf[:n], err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+
+	var ps syscall.Termios
+	p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps))
+	ps.Lflag |= syscall.ECHO | syscall.ICANON
+	p.ioctlPtr(syscall.TCSETS, unsafe.Pointer(&ps))
+
+	if err := p.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps))
+	if ps.Lflag&(syscall.ECHO|syscall.ICANON) != 0 {
+		t.Fatalf("Lflag %o after Reset, want raw mode", ps.Lflag)
+	}
+}
+
+func TestSuspendOutput(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	if err := p.SuspendOutput(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Write([]byte("x"))
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := m.Read(buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case s := <-got:
+		t.Fatalf("received %q while output is suspended", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := p.ResumeOutput(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-got:
+		if s != "x" {
+			t.Fatalf("received %q, want \"x\"", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing received after ResumeOutput")
+	}
+}
+
+func TestOpenFirstMatch(t *testing.T) {
+	_, name := openPty(t)
+	dir := t.TempDir()
+	os.Symlink("/dev/nonexistent-tty", dir+"/tty-a")
+	os.Symlink(name, dir+"/tty-b")
+
+	p, err := OpenFirstMatch(dir+"/tty-*", &Config{Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Name() != dir+"/tty-b" {
+		t.Fatalf("opened %s, want tty-b", p.Name())
+	}
+
+	if _, err := OpenFirstMatch(dir+"/tty-a*", &Config{Baud: 9600}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenFirstMatch error = %v; want os.ErrNotExist", err)
+	}
+}
+
+func TestWriteRS485(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	// a pty has no modem lines, so only the data can be checked
+	err := p.WriteRS485([]byte("req"), time.Millisecond, time.Millisecond)
+	if err != nil && !errors.Is(err, syscall.ENOTTY) && !errors.Is(err, syscall.EINVAL) {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Skip("no RTS on a pty:", err)
+	}
+	buf := make([]byte, 16)
+	if n, err := m.Read(buf); err != nil || string(buf[:n]) != "req" {
+		t.Fatalf("Read = %q, %v; want \"req\"", buf[:n], err)
+	}
+}
+
+func TestInputOverruns(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+
+	// a pty keeps no counters
+	n, err := p.InputOverruns()
+	if err == nil && n != 0 {
+		t.Fatalf("InputOverruns = %d; want 0", n)
+	}
+	if err != nil && !errors.Is(err, syscall.ENOTTY) && !errors.Is(err, syscall.EINVAL) {
+		t.Fatal(err)
+	}
+}
+
+func TestLineCounters(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+
+	lc, err := p.LineCounters()
+	if err != nil {
+		if errors.Is(err, syscall.ENOTTY) || errors.Is(err, syscall.EINVAL) {
+			t.Skip("no counters on a pty:", err)
+		}
+		t.Fatal(err)
+	}
+	if lc.Frame != 0 || lc.Parity != 0 {
+		t.Fatalf("LineCounters = %+v; want no errors", lc)
+	}
+}
+
+func TestReadAvailable(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: time.Second})
+
+	go func() {
+		m.Write([]byte("ab"))
+		time.Sleep(5 * time.Millisecond)
+		m.Write([]byte("cd"))
+		time.Sleep(100 * time.Millisecond)
+		m.Write([]byte("ef"))
+	}()
+	buf := make([]byte, 16)
+	if n, err := p.ReadAvailable(buf); err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("ReadAvailable = %q, %v; want \"abcd\"", buf[:n], err)
+	}
+	if n, err := p.ReadAvailable(buf[:1]); err != nil || string(buf[:n]) != "e" {
+		t.Fatalf("ReadAvailable = %q, %v; want \"e\"", buf[:n], err)
+	}
+}
+
+func TestWriteWithParity(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	if err := p.WriteWithParity(0x42, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Write([]byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := io.ReadAtLeast(m, buf, 2)
+	if err != nil || string(buf[:n]) != "\x42\x01" {
+		t.Fatalf("Read = % x, %v; want 42 01", buf[:n], err)
+	}
+	// a pty ignores the parity, check that the configuration is back
+	if p.cfg.Parity != 0 {
+		t.Fatalf("Parity = %c after WriteWithParity", p.cfg.Parity)
+	}
+}
+
+// run with -race: the held back input of DetectBreak is shared with Read
+func TestFlushDuringRead(t *testing.T) {
+	m, p := openTestPort(t, &Config{DetectBreak: true, ReadTimeout: 100 * time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4)
+		for i := 0; i < 20; i++ {
+			p.Read(buf)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		m.Write([]byte{0xFF, 'a', 'b'})
+		p.Available()
+		if err := p.FlushWith(FlushRx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestAvailableDuringRead(t *testing.T) {
+	m, p := openTestPort(t, &Config{DetectBreak: true})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Read(make([]byte, 4))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// a blocked Read mustn't hold up Available
+	avail := make(chan error, 1)
+	go func() {
+		_, err := p.Available()
+		avail <- err
+	}()
+	select {
+	case err := <-avail:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Available blocked by a pending Read")
+	}
+	go func() {
+		_, err := p.Probe()
+		avail <- err
+	}()
+	select {
+	case <-avail:
+	case <-time.After(time.Second):
+		t.Fatal("Probe blocked by a pending Read")
+	}
+	m.Write([]byte("x"))
+	<-done
+}
+
+func TestDiscardInput(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond})
+
+	m.Write([]byte("stale data"))
+	time.Sleep(20 * time.Millisecond)
+	if n, err := p.Available(); err != nil || n != 10 {
+		t.Fatalf("Available = %d, %v; want 10", n, err)
+	}
+	if n, err := p.DiscardInput(); err != nil || n != 10 {
+		t.Fatalf("DiscardInput = %d, %v; want 10", n, err)
+	}
+	if n, err := p.Available(); err != nil || n != 0 {
+		t.Fatalf("Available after discard = %d, %v; want 0", n, err)
+	}
+}
+
+func TestSetFlowControl(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+
+	if err := p.SetFlowControl(FlowXONXOFF); err != nil {
+		t.Fatal(err)
+	}
+	var ps syscall.Termios
+	if err := p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps)); err != nil {
+		t.Fatal(err)
+	}
+	if ps.Iflag&(syscall.IXON|syscall.IXOFF) != syscall.IXON|syscall.IXOFF {
+		t.Fatalf("Iflag = %#o; want IXON and IXOFF", ps.Iflag)
+	}
+	if err := p.SetFlowControl(FlowNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ioctlPtr(syscall.TCGETS, unsafe.Pointer(&ps)); err != nil {
+		t.Fatal(err)
+	}
+	if ps.Iflag&(syscall.IXON|syscall.IXOFF) != 0 {
+		t.Fatalf("Iflag = %#o; want no IXON or IXOFF", ps.Iflag)
+	}
+	if err := p.SetFlowControl(FlowControl(7)); err == nil {
+		t.Fatal("SetFlowControl(7) succeeded")
+	}
+}
+
+func TestKeepNonBlock(t *testing.T) {
+	m, p := openTestPort(t, &Config{KeepNonBlock: true})
+
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); n != 0 || err != ErrWouldBlock {
+		t.Fatalf("Read = %d, %v; want 0, ErrWouldBlock", n, err)
+	}
+	m.Write([]byte("hi"))
+	if ready, err := p.WaitForData(time.Second); err != nil || !ready {
+		t.Fatalf("WaitForData = %t, %v", ready, err)
+	}
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("Read = %q, %v; want \"hi\"", buf[:n], err)
+	}
+
+	// the descriptor stays non-blocking, so the mode is kept
+	if err := p.ApplyConfig(&Config{Baud: 9600, ReadTimeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := p.Read(buf); n != 0 || err != ErrWouldBlock {
+		t.Fatalf("Read after ApplyConfig = %d, %v; want 0, ErrWouldBlock", n, err)
+	}
+}
+
+func TestBaudConstant(t *testing.T) {
+	if b, ok := BaudConstant(9600); !ok || b != syscall.B9600 {
+		t.Fatalf("BaudConstant(9600) = %#o, %t; want B9600", b, ok)
+	}
+	if _, ok := BaudConstant(12345); ok {
+		t.Fatal("BaudConstant(12345) is standard")
+	}
+}
+
+func TestReadBurst(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 2 * time.Second})
+
+	go func() {
+		m.Write([]byte("abc"))
+		time.Sleep(20 * time.Millisecond)
+		m.Write([]byte("def"))
+		time.Sleep(300 * time.Millisecond)
+		m.Write([]byte("next"))
+	}()
+	start := time.Now()
+	b, err := p.ReadBurst(100*time.Millisecond, 0)
+	if err != nil || string(b) != "abcdef" {
+		t.Fatalf("ReadBurst = %q, %v; want \"abcdef\"", b, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("ReadBurst took %v, it should end at the pause", d)
+	}
+	if b, err = p.ReadBurst(100*time.Millisecond, 2); err != nil || string(b) != "ne" {
+		t.Fatalf("ReadBurst max 2 = %q, %v; want \"ne\"", b, err)
+	}
+}
+
+func TestStickyErr(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond})
+
+	buf := make([]byte, 16)
+	if _, err := p.Read(buf); err != ErrTimeout {
+		t.Fatalf("Read = %v; want ErrTimeout", err)
+	}
+	if err := p.Err(); err != nil {
+		t.Fatalf("Err after a timeout = %v", err)
+	}
+	// writing to a pty without master fails
+	m.Close()
+	_, werr := p.Write([]byte("x"))
+	if werr == nil || p.Err() != werr {
+		t.Fatalf("Err = %v after the write error %v", p.Err(), werr)
+	}
+	p.File().Close()
+	p.Write([]byte("x"))
+	if p.Err() != werr {
+		t.Fatalf("Err = %v; want the first error %v", p.Err(), werr)
+	}
+}
+
+func TestDrainOnClose(t *testing.T) {
+	m, p := openTestPort(t, &Config{DrainOnClose: true})
+
+	if _, err := p.Write([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, _ := m.Read(buf); string(buf[:n]) != "last" {
+		t.Errorf("master read %q; want \"last\"", buf[:n])
+	}
+}
+
+func TestFlushOnClose(t *testing.T) {
+	m, p := openTestPort(t, &Config{FlushOnClose: true})
+	// a second port on the device keeps the input queue alive
+	q, err := OpenPort(&Config{Name: p.Name(), Baud: 9600, ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	m.Write([]byte("pending"))
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := q.Read(buf); err != ErrTimeout {
+		t.Fatalf("Read after Close = %q, %v; want the input discarded", buf[:n], err)
+	}
+}
+
+func TestFlushOnCloseDuringRead(t *testing.T) {
+	m, p := openTestPort(t, &Config{FlushOnClose: true})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Read(make([]byte, 4))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// closing the port is the way to stop a reader, it mustn't wait for it
+	closed := make(chan error, 1)
+	go func() { closed <- p.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by a pending Read")
+	}
+	m.Write([]byte("x"))
+	<-done
+}
+
+func TestReadRune(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond, LogCharset: UTF8})
+
+	m.Write([]byte("aП\xff"))
+	for _, want := range []struct {
+		r    rune
+		size int
+	}{{'a', 1}, {'П', 2}, {0xFFFD, 1}} {
+		if r, size, err := p.ReadRune(); err != nil || r != want.r || size != want.size {
+			t.Fatalf("ReadRune = %q, %d, %v; want %q, %d", r, size, err, want.r, want.size)
+		}
+	}
+	if _, _, err := p.ReadRune(); err != ErrTimeout {
+		t.Fatalf("ReadRune = %v; want ErrTimeout", err)
+	}
+
+	p.cfg.LogCharset = KOI8R
+	m.Write([]byte{0xF0})
+	if r, _, err := p.ReadRune(); err != nil || r != 'П' {
+		t.Fatalf("ReadRune KOI8R = %q, %v; want 'П'", r, err)
+	}
+}
+
+func TestReadRuneTruncated(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond, LogCharset: UTF8})
+
+	// the byte ending a truncated sequence is the next character
+	m.Write([]byte("\xC3AB\xE2x"))
+	for _, want := range []struct {
+		r    rune
+		size int
+	}{{0xFFFD, 1}, {'A', 1}, {'B', 1}, {0xFFFD, 1}} {
+		if r, size, err := p.ReadRune(); err != nil || r != want.r || size != want.size {
+			t.Fatalf("ReadRune = %q, %d, %v; want %q, %d", r, size, err, want.r, want.size)
+		}
+	}
+	// also for Read
+	buf := make([]byte, 4)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "x" {
+		t.Fatalf("Read = %q, %v; want \"x\"", buf[:n], err)
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+	p.Close()
+	// the closed file would fail any syscall
+	for _, b := range [][]byte{nil, {}} {
+		if n, err := p.Write(b); n != 0 || err != nil {
+			t.Errorf("Write(%q) = %d, %v; want 0, nil", b, n, err)
+		}
+	}
+}
+
+func TestInheritFD(t *testing.T) {
+	cloexec := func(p *Port) bool {
+		var flags uintptr
+		rc, _ := p.File().SyscallConn()
+		rc.Control(func(fd uintptr) {
+			flags, _, _ = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFD, 0)
+		})
+		return flags&syscall.FD_CLOEXEC != 0
+	}
+	for _, inherit := range []bool{false, true} {
+		_, p := openTestPort(t, &Config{InheritFD: inherit})
+		if cloexec(p) == inherit {
+			t.Errorf("InheritFD %t: close-on-exec is %t", inherit, cloexec(p))
+		}
+	}
+}
+
+func TestOpenFD(t *testing.T) {
+	m, name := openPty(t)
+	f, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := OpenFD(uintptr(fd), &Config{Baud: 9600, ReadTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.dev != name {
+		t.Errorf("dev = %q; want %q", p.dev, name)
+	}
+	m.Write([]byte("hi"))
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("Read = %q, %v; want \"hi\"", buf[:n], err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	m.Write([]byte("abc"))
+	time.Sleep(20 * time.Millisecond)
+	// a pty has no modem lines, that error mustn't hide the rest
+	s, _ := p.Probe()
+	if !s.Open || s.BytesAvailable != 3 {
+		t.Fatalf("Probe = %+v; want open with 3 bytes", s)
+	}
+	p.Close()
+	if s, err := p.Probe(); s.Open || !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Probe after Close = %+v, %v", s, err)
+	}
+}
+
+func TestSetBaudDrain(t *testing.T) {
+	m, p := openTestPort(t, &Config{Baud: 9600, ReadTimeout: time.Second})
+
+	m.Write([]byte("ok"))
+	time.Sleep(20 * time.Millisecond)
+	if _, err := p.Write([]byte("SPEED 115200\r")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetBaudDrain(115200); err != nil {
+		t.Fatal(err)
+	}
+	if p.cfg.Baud != 115200 {
+		t.Fatalf("Baud = %d; want 115200", p.cfg.Baud)
+	}
+	// the input received before the change is kept
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("Read = %q, %v; want \"ok\"", buf[:n], err)
+	}
+}
+
+func TestSetBlocking(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 100 * time.Millisecond})
+
+	if err := p.SetBlocking(true); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		m.Write([]byte("hi"))
+	}()
+	buf := make([]byte, 16)
+	start := time.Now()
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("blocking Read = %q, %v; want \"hi\"", buf[:n], err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("blocking Read returned after %v", d)
+	}
+	if err := p.SetBlocking(false); err != nil {
+		t.Fatal(err)
+	}
+	if p.cfg.ReadTimeout != 100*time.Millisecond {
+		t.Fatalf("ReadTimeout = %v after SetBlocking(false)", p.cfg.ReadTimeout)
+	}
+	if _, err := p.Read(buf); err != ErrTimeout {
+		t.Fatalf("Read = %v; want ErrTimeout", err)
+	}
+}
+
+func TestReadDeadlineBudget(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 5 * time.Second})
+
+	go func() {
+		m.Write([]byte("ab"))
+		time.Sleep(50 * time.Millisecond)
+		m.Write([]byte("cd"))
+	}()
+	buf := make([]byte, 4)
+	if n, err := p.ReadDeadline(buf, time.Now().Add(time.Second)); err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("ReadDeadline = %q, %v; want \"abcd\"", buf[:n], err)
+	}
+
+	m.Write([]byte("e"))
+	start := time.Now()
+	n, err := p.ReadDeadline(buf, start.Add(200*time.Millisecond))
+	if err != ErrTimeout || string(buf[:n]) != "e" {
+		t.Fatalf("ReadDeadline = %q, %v; want \"e\", ErrTimeout", buf[:n], err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("ReadDeadline took %v, past its deadline", d)
+	}
+}
+
+func TestWithBaud(t *testing.T) {
+	_, p := openTestPort(t, &Config{Baud: 9600})
+
+	errFn := errors.New("transfer failed")
+	err := p.WithBaud(115200, func() error {
+		if p.cfg.Baud != 115200 {
+			t.Errorf("Baud = %d in fn; want 115200", p.cfg.Baud)
+		}
+		return errFn
+	})
+	if err != errFn {
+		t.Fatalf("WithBaud = %v; want the error of fn", err)
+	}
+	if p.cfg.Baud != 9600 {
+		t.Fatalf("Baud = %d after WithBaud; want 9600", p.cfg.Baud)
+	}
+}
+
+func TestRawCapture(t *testing.T) {
+	dir := t.TempDir()
+	rx, tx := dir+"/rx.bin", dir+"/tx.bin"
+	m, p := openTestPort(t, &Config{ReadTimeout: time.Second, RawCaptureFile: rx, RawCaptureTxFile: tx})
+
+	m.Write([]byte{0x00, 0xff, 'a'})
+	buf := make([]byte, 16)
+	if _, err := p.ReadAtLeast(buf, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Write([]byte("cmd\r")); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if b, err := os.ReadFile(rx); err != nil || string(b) != "\x00\xffa" {
+		t.Fatalf("rx capture = %q, %v", b, err)
+	}
+	if b, err := os.ReadFile(tx); err != nil || string(b) != "cmd\r" {
+		t.Fatalf("tx capture = %q, %v", b, err)
+	}
+}
+
+func TestOpenInterface(t *testing.T) {
+	_, name := openPty(t)
+	sp, err := Open(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.Name() != name {
+		t.Errorf("Name = %q; want %q", sp.Name(), name)
+	}
+	sp.Close()
+
+	if sp, err := Open(&Config{Name: "/nonexistent/tty", Baud: 9600}); sp != nil || err == nil {
+		t.Fatalf("Open of a missing device = %v, %v; want nil and an error", sp, err)
+	}
+}
+
+func TestSetModemLines(t *testing.T) {
+	_, p := openTestPort(t, &Config{})
+
+	on, off := true, false
+	err := p.SetModemLines(&on, &off)
+	if errors.Is(err, syscall.ENOTTY) || errors.Is(err, syscall.EINVAL) {
+		t.Skip("no modem lines on a pty:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := p.Lines(); err != nil || !l.DTR || l.RTS {
+		t.Fatalf("Lines = %v, %v; want DTR+ RTS-", l, err)
+	}
+}
+
+func TestPortExists(t *testing.T) {
+	_, name := openPty(t)
+	if !PortExists(name) {
+		t.Errorf("PortExists(%q) = false", name)
+	}
+	if !PortExists(strings.TrimPrefix(name, "/dev/")) {
+		t.Errorf("PortExists without /dev = false")
+	}
+	if PortExists("/nonexistent/tty") || PortExists(t.TempDir()) {
+		t.Errorf("PortExists is true for a missing device or a directory")
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	events, stop, err := watchDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	os.WriteFile(dir+"/notaport", nil, 0644)
+	os.WriteFile(dir+"/ttyUSB7", nil, 0644)
+	os.Remove(dir + "/ttyUSB7")
+	for _, want := range []PortEvent{{dir + "/ttyUSB7", true}, {dir + "/ttyUSB7", false}} {
+		select {
+		case ev := <-events:
+			if ev != want {
+				t.Fatalf("event %+v; want %+v", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %+v", want)
+		}
+	}
+	stop()
+	if _, ok := <-events; ok {
+		t.Fatal("events not closed by stop")
+	}
+}
+
+func TestLongReadTimeoutHangup(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 30 * time.Second})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.Close()
+	}()
+	start := time.Now()
+	buf := make([]byte, 16)
+	n, _ := p.Read(buf)
+	if n != 0 || time.Since(start) > 5*time.Second {
+		t.Fatalf("Read = %d after %v; want 0 soon after the hangup", n, time.Since(start))
+	}
+}
+
+func TestReadTimeoutHangup(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: time.Second})
+
+	m.Close()
+	start := time.Now()
+	buf := make([]byte, 16)
+	if n, err := p.Read(buf); n != 0 || err != io.EOF || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("Read = %d, %v after %v; want io.EOF at once", n, err, time.Since(start))
+	}
+	// a deadline of zero waits forever, but not on a hung up port
+	if _, err := p.ReadDeadline(buf, time.Time{}); err != io.EOF {
+		t.Fatalf("ReadDeadline = %v; want io.EOF", err)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 200 * time.Millisecond})
+
+	m.Write([]byte("a\nb\r\nOK\r\nrest"))
+	eol := []byte("\r\n")
+	if s, err := p.ReadLine(eol, false, 0); err != nil || s != "a\nb\r\n" {
+		t.Fatalf("ReadLine = %q, %v; want \"a\\nb\\r\\n\"", s, err)
+	}
+	if s, err := p.ReadLine(eol, true, 0); err != nil || s != "OK" {
+		t.Fatalf("ReadLine = %q, %v; want \"OK\"", s, err)
+	}
+	if s, err := p.ReadLine(eol, true, 0); err != ErrTimeout || s != "rest" {
+		t.Fatalf("ReadLine = %q, %v; want \"rest\", ErrTimeout", s, err)
+	}
+}
+
+func TestReadUntilTimeout(t *testing.T) {
+	m, p := openTestPort(t, &Config{ReadTimeout: 5 * time.Second})
+
+	m.Write([]byte("ab"))
+	start := time.Now()
+	b, err := p.ReadUntil('\n', 100*time.Millisecond)
+	if err != ErrTimeout || string(b) != "ab" {
+		t.Fatalf("ReadUntil = %q, %v; want \"ab\", ErrTimeout", b, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("ReadUntil took %v, the port ReadTimeout instead of its own", d)
+	}
+}
+
+func TestWriteMulti(t *testing.T) {
+	m, p := openTestPort(t, &Config{})
+
+	n, err := p.WriteMulti([]byte{0x01, 0x03}, nil, []byte("data"), []byte{0x5a})
+	if err != nil || n != 7 {
+		t.Fatalf("WriteMulti = %d, %v; want 7", n, err)
+	}
+	buf := make([]byte, 16)
+	n, err = io.ReadAtLeast(m, buf, 7)
+	if err != nil || string(buf[:n]) != "\x01\x03data\x5a" {
+		t.Fatalf("Read = % x, %v", buf[:n], err)
+	}
+}
+
+func TestDeviceInfo(t *testing.T) {
+	_, p := openTestPort(t, &Config{Baud: 9600})
+	defer p.Close()
+	// a pty has no device in sysfs
+	info, err := p.DeviceInfo()
+	if err == nil {
+		t.Errorf("DeviceInfo on a pty = %+v, want an error", info)
+	}
+	if info.Name == "" {
+		t.Errorf("DeviceInfo has no Name")
+	}
+}
@@ -3,7 +3,10 @@
 package serial
 
 import (
+	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"syscall"
 	"time"
 	"unsafe"
@@ -13,8 +16,23 @@ type Port struct {
 	BasePort
 }
 
+// Port can be used wherever an io.ReadWriteCloser is expected
+var _ io.ReadWriteCloser = (*Port)(nil)
+
+// maxVTime is the longest timeout VTIME can express
+const maxVTime = 255 * 100 * time.Millisecond
+
 // Converts the timeout values for Linux / POSIX systems
-func posixTimeoutValues(readTimeout time.Duration) (vmin uint8, vtime uint8) {
+func posixTimeoutValues(c *Config) (vmin uint8, vtime uint8) {
+	readTimeout := c.ReadTimeout
+	if c.UseDeadlines {
+		// the runtime poller does the waiting
+		return 1, 0
+	}
+	if c.NonBlocking {
+		// return immediately, even with no data
+		return 0, 0
+	}
 	// set blocking / non-blocking read
 	vmin = 1
 	vtime = 0
@@ -28,43 +46,523 @@ func posixTimeoutValues(readTimeout time.Duration) (vmin uint8, vtime uint8) {
 			// min possible timeout 1 Deciseconds (0.1s)
 			vtime = 1
 		} else if vt > 255 {
-			// max possible timeout is 255 deciseconds (25.5s)
+			// max possible timeout is 255 deciseconds (25.5s),
+			// readRaw waits for the rest
 			vtime = 255
 		} else {
 			vtime = uint8(vt)
 		}
 	}
+	if c.MinBytes > 0 {
+		// VTIME turns into an inter-byte timer
+		vmin = 255
+		if c.MinBytes < 255 {
+			vmin = uint8(c.MinBytes)
+		}
+	}
 	return
 }
 
-func (p *Port) Read(buf []byte) (n int, err error) {
-	n, err = p.f.Read(buf)
+// inheritFD clears the close-on-exec flag of f, see Config.InheritFD
+func inheritFD(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var e syscall.Errno
+	if err = rc.Control(func(fd uintptr) {
+		_, _, e = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0)
+	}); err != nil {
+		return err
+	}
+	if e != 0 {
+		return SerialError{Msg: "Clearing FD_CLOEXEC", Err: e}
+	}
+	return nil
+}
+
+// realDevice resolves links like /dev/serial/by-id/... to the device
+// they point to, the name is kept if that fails
+func realDevice(name string) string {
+	if dev, err := filepath.EvalSymlinks(name); err == nil {
+		return dev
+	}
+	return name
+}
+
+// termiosStopBits returns whether c needs CSTOPB. Termios has no 1.5
+// stop bits, but UARTs send them for CSTOPB with 5 data bits.
+func termiosStopBits(c *Config, bits int) (bool, error) {
+	switch {
+	case c.StopBits == 0 || c.StopBits == StopBits1:
+		return false, nil
+	case c.StopBits == StopBits2:
+		return true, nil
+	case c.StopBits == StopBits1Half && bits == 5:
+		return true, nil
+	}
+	return false, SerialError{Msg: "Unsupported stop bits", Cod: int(c.StopBits)}
+}
+
+// checkFlowControl rejects unknown flow control modes
+func checkFlowControl(c *Config) error {
+	switch c.FlowControl {
+	case FlowNone, FlowRTSCTS, FlowXONXOFF:
+		return nil
+	}
+	return SerialError{Msg: "Unsupported flow control", Cod: int(c.FlowControl)}
+}
+
+// PortExists reports whether the device exists, without opening it. A
+// name without a path, like "ttyUSB0", is looked up in /dev.
+func PortExists(name string) bool {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join("/dev", name)
+	}
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// matchPorts returns the device names matching glob
+func matchPorts(glob string) ([]string, error) {
+	return filepath.Glob(glob)
+}
+
+// tcflushQueue maps flags to the tcflush queue selector.
+// The abort flags have no termios counterpart.
+func tcflushQueue(flags FlushFlags) (int, bool) {
+	switch flags & (FlushRx | FlushTx) {
+	case FlushRx:
+		return syscall.TCIFLUSH, true
+	case FlushTx:
+		return syscall.TCOFLUSH, true
+	case FlushRx | FlushTx:
+		return syscall.TCIOFLUSH, true
+	}
+	return 0, false
+}
+
+func (p *Port) read(buf []byte) (n int, err error) {
+	defer func() { p.setErr("Read", err) }()
+	if p.cfg.DetectBreak {
+		return p.readMarked(buf)
+	}
+	if n = p.takePending(buf); n > 0 {
+		return n, nil
+	}
+	return p.readRaw(buf)
+}
+
+func (p *Port) readRaw(buf []byte) (n int, err error) {
+	if p.cfg.KeepNonBlock {
+		return p.readNonBlock(buf)
+	}
+	if p.cfg.UseDeadlines {
+		return p.readDeadline(buf)
+	}
+	start := time.Now()
+	if p.longTimeout() {
+		n, err = p.readLong(buf)
+	} else {
+		n, err = p.fileRead(buf)
+	}
 	if err != nil && err != io.EOF {
-		p.logMsg("Read", "Error %d", err)
+		p.logMsg("Read", "Error %s", err)
 		return 0, err
 	} else if n > 0 {
-		p.logData('+', buf)
+		p.logData('+', buf[:n])
+		return n, nil
+	}
+	return 0, p.emptyRead(start)
+}
+
+// longTimeout reports whether ReadTimeout exceeds what VTIME can wait
+func (p *Port) longTimeout() bool {
+	return !p.cfg.NonBlocking && p.cfg.MinBytes == 0 && p.cfg.ReadTimeout > maxVTime
+}
+
+// readLong reads with a ReadTimeout longer than maxVTime by repeating
+// the read, waiting only for the remaining time in the last round
+func (p *Port) readLong(buf []byte) (n int, err error) {
+	deadline := time.Now().Add(p.cfg.ReadTimeout)
+	for {
+		start := time.Now()
+		n, err = p.fileRead(buf)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return
+		}
+		// an empty read before VTIME ran out is a hangup
+		if time.Since(start) < maxVTime-time.Second {
+			return
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return
+		}
+		if left < maxVTime {
+			ready, werr := p.waitForData(left)
+			if werr != nil || !ready {
+				return 0, werr
+			}
+			n, err = p.fileRead(buf)
+			return
+		}
+	}
+}
+
+// fileRead reads from the file, retrying after a signal interrupted it
+// and, up to ReadRetries times, after a transient error
+func (p *Port) fileRead(buf []byte) (n int, err error) {
+	retries := p.cfg.ReadRetries
+	for {
+		n, err = p.f.Read(buf)
+		if n > 0 || err == nil {
+			return
+		}
+		// a signal interrupted the read before any data came in
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if retries > 0 && (errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EAGAIN)) {
+			retries--
+			p.logMsg("Read", "Error %s, retrying", err)
+			continue
+		}
+		return
+	}
+}
+
+// readMarked reads with the PARMRK marking of breaks removed. Data
+// before a break is returned first, then 0 and ErrBreak.
+func (p *Port) readMarked(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	for {
+		p.pendMu.Lock()
+		brk, complete := p.rxBreak, p.rxComplete()
+		p.rxBreak = false
+		p.pendMu.Unlock()
+		if brk {
+			return 0, ErrBreak
+		}
+		if !complete {
+			raw := make([]byte, len(buf))
+			m, err := p.readRaw(raw)
+			if m == 0 {
+				return 0, err
+			}
+			p.pendMu.Lock()
+			p.rxPend = append(p.rxPend, raw[:m]...)
+			p.pendMu.Unlock()
+		}
+		p.pendMu.Lock()
+		n := p.unmark(buf)
+		short := n == 0 && p.rxComplete() && !p.rxBreak
+		p.pendMu.Unlock()
+		if n > 0 {
+			return n, nil
+		}
+		if short {
+			// a parity mark doesn't fit
+			return 0, io.ErrShortBuffer
+		}
+	}
+}
+
+// unmark moves the received data from rxPend to buf up to a break,
+// leaving incomplete marks in rxPend. With PARMRK a break reads as
+// FF 00 00, a FF data byte as FF FF and a parity error as FF 00 <byte>.
+// The latter two are kept for MarkParityErrors. pendMu must be held.
+func (p *Port) unmark(buf []byte) (n int) {
+	src := p.rxPend
+	keep := p.cfg.MarkParityErrors
+	i := 0
+	for i < len(src) && n < len(buf) && !p.rxBreak {
+		if src[i] != 0xFF {
+			buf[n] = src[i]
+			n++
+			i++
+			continue
+		}
+		if i+1 >= len(src) {
+			break
+		}
+		if src[i+1] != 0x00 {
+			// FF FF
+			if !keep {
+				buf[n] = src[i+1]
+				n++
+			} else if n+2 <= len(buf) {
+				n += copy(buf[n:], src[i:i+2])
+			} else {
+				break
+			}
+			i += 2
+			continue
+		}
+		if i+2 >= len(src) {
+			break
+		}
+		if src[i+2] == 0x00 {
+			p.rxBreak = true
+		} else if !keep {
+			buf[n] = src[i+2]
+			n++
+		} else if n+3 <= len(buf) {
+			n += copy(buf[n:], src[i:i+3])
+		} else {
+			break
+		}
+		i += 3
+	}
+	p.rxPend = src[:copy(src, src[i:])]
+	return n
+}
+
+// rawRead reads once from the descriptor without waiting for the
+// runtime poller, an empty non-blocking descriptor gives EAGAIN
+func (p *Port) rawRead(buf []byte) (n int, err error) {
+	rc, err := p.f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	rerr := rc.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), buf)
+		return true
+	})
+	if n < 0 {
+		n = 0
+	}
+	if rerr != nil {
+		err = rerr
+	}
+	return n, err
+}
+
+// readNonBlock reads for KeepNonBlock, ErrWouldBlock means no data
+func (p *Port) readNonBlock(buf []byte) (int, error) {
+	for {
+		n, err := p.rawRead(buf)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EAGAIN:
+			return 0, ErrWouldBlock
+		case err != nil:
+			p.logMsg("Read", "Error %s", err)
+			return 0, err
+		case n == 0:
+			// hangup
+			return 0, io.EOF
+		}
+		p.logData('+', buf[:n])
 		return n, nil
 	}
-	return 0, nil
 }
 
-func (p *Port) Write(buf []byte) (n int, err error) {
-	n, err = p.f.Write(buf)
+// readDeadline reads through the runtime poller, the timeout
+// is a read deadline instead of VTIME
+func (p *Port) readDeadline(buf []byte) (n int, err error) {
+	switch {
+	case p.cfg.NonBlocking:
+		// take what is there without waiting for the poller
+		n, err = p.rawRead(buf)
+		if err == syscall.EAGAIN {
+			err = nil
+		}
+	case p.cfg.ReadTimeout > 0:
+		if err = p.f.SetReadDeadline(time.Now().Add(p.cfg.ReadTimeout)); err != nil {
+			return 0, err
+		}
+		fallthrough
+	default:
+		n, err = p.fileRead(buf)
+	}
+	if n > 0 {
+		p.logData('+', buf[:n])
+	}
+	if err != nil && err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+		p.logMsg("Read", "Error %s", err)
+	}
+	return n, err
+}
+
+func (p *Port) write(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	defer func() { p.setErr("Write", err) }()
+	for {
+		var m int
+		m, err = p.f.Write(buf[n:])
+		n += m
+		// continue after a signal interrupted the write
+		if !errors.Is(err, syscall.EINTR) || n >= len(buf) {
+			break
+		}
+	}
+	if n > 0 {
+		p.logData('-', buf[:n])
+	}
 	if err != nil {
 		p.logMsg("Write", err.Error())
-	} else if n > 0 {
-		p.logData('-', buf)
 	}
 	return
 }
 
+// writev writes the buffers with the writev syscall, repeating it for
+// the rest after a partial write
+func (p *Port) writev(bufs [][]byte) (n int, err error) {
+	defer func() { p.setErr("Write", err) }()
+	const maxIOV = 1024
+	rc, err := p.f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	rest := bufs
+	for {
+		var iov []syscall.Iovec
+		for _, b := range rest {
+			if len(b) > 0 && len(iov) < maxIOV {
+				v := syscall.Iovec{Base: &b[0]}
+				v.SetLen(len(b))
+				iov = append(iov, v)
+			}
+		}
+		if len(iov) == 0 {
+			break
+		}
+		var m uintptr
+		var errno syscall.Errno
+		err = rc.Write(func(fd uintptr) bool {
+			m, _, errno = syscall.Syscall(syscall.SYS_WRITEV, fd,
+				uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+			// wait for the poller if the file is non-blocking
+			return errno != syscall.EAGAIN
+		})
+		if err == nil && errno != 0 && errno != syscall.EINTR {
+			err = errno
+		}
+		if err != nil {
+			break
+		}
+		if errno == 0 {
+			if m == 0 {
+				err = io.ErrShortWrite
+				break
+			}
+			n += int(m)
+			rest = skipBytes(rest, int(m))
+		}
+	}
+	for i, left := 0, n; i < len(bufs) && left > 0; i++ {
+		b := bufs[i]
+		if len(b) > left {
+			b = b[:left]
+		}
+		p.logData('-', b)
+		left -= len(b)
+	}
+	if err != nil {
+		p.logMsg("Write", err.Error())
+	}
+	return n, err
+}
+
+// skipBytes drops the first m bytes from bufs
+func skipBytes(bufs [][]byte, m int) [][]byte {
+	for len(bufs) > 0 && m >= len(bufs[0]) {
+		m -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if len(bufs) > 0 && m > 0 {
+		bufs = append([][]byte{bufs[0][m:]}, bufs[1:]...)
+	}
+	return bufs
+}
+
 func (p *Port) SetDtr(v bool) error {
-	return p.setModemLine("DTR", syscall.TIOCM_DTR, v)
+	return p.wrapErr("SetDtr", p.setModemLine("DTR", syscall.TIOCM_DTR, v))
 }
 
 func (p *Port) SetRts(v bool) error {
-	return p.setModemLine("RTS", syscall.TIOCM_RTS, v)
+	return p.wrapErr("SetRts", p.setModemLine("RTS", syscall.TIOCM_RTS, v))
+}
+
+// SetModemLines sets DTR and RTS together with one TIOCMSET, so they
+// change at the same time. A nil value leaves the line unchanged.
+func (p *Port) SetModemLines(dtr, rts *bool) error {
+	// a SetDtr or SetRts between the get and the set would be lost
+	p.lineMu.Lock()
+	defer p.lineMu.Unlock()
+	status, err := p.getModemLines()
+	if err == nil {
+		for _, l := range []struct {
+			v   *bool
+			bit uint32
+		}{{dtr, syscall.TIOCM_DTR}, {rts, syscall.TIOCM_RTS}} {
+			switch {
+			case l.v == nil:
+			case *l.v:
+				status |= l.bit
+			default:
+				status &^= l.bit
+			}
+		}
+		err = p.ioctlPtr(syscall.TIOCMSET, unsafe.Pointer(&status))
+	}
+	if err != nil {
+		p.logMsg("Lines", "%s -> error %s", modemLinesString(dtr, rts), err)
+		return p.wrapErr("SetModemLines", err)
+	}
+	p.logControl("Lines", modemLinesString(dtr, rts))
+	return nil
+}
+
+// GetDtr returns the current state of the DTR output line
+func (p *Port) GetDtr() (bool, error) {
+	status, err := p.getModemLines()
+	return status&syscall.TIOCM_DTR != 0, p.wrapErr("GetDtr", err)
+}
+
+// GetRts returns the current state of the RTS output line
+func (p *Port) GetRts() (bool, error) {
+	status, err := p.getModemLines()
+	return status&syscall.TIOCM_RTS != 0, p.wrapErr("GetRts", err)
+}
+
+// Lines returns the state of all modem lines in one call
+func (p *Port) Lines() (Lines, error) {
+	l, err := p.lines()
+	if err != nil {
+		p.logMsg("Lines", "Error %s", err)
+		return Lines{}, p.wrapErr("Lines", err)
+	}
+	p.logControl("Lines", l.String())
+	return l, nil
+}
+
+// lines is Lines without the logging
+func (p *Port) lines() (Lines, error) {
+	status, err := p.getModemLines()
+	if err != nil {
+		return Lines{}, err
+	}
+	return Lines{
+		CTS: status&syscall.TIOCM_CTS != 0,
+		DSR: status&syscall.TIOCM_DSR != 0,
+		RI:  status&syscall.TIOCM_RI != 0,
+		DCD: status&syscall.TIOCM_CD != 0,
+		DTR: status&syscall.TIOCM_DTR != 0,
+		RTS: status&syscall.TIOCM_RTS != 0,
+	}, nil
+}
+
+func (p *Port) getModemLines() (uint32, error) {
+	var status uint32
+	err := p.ioctlPtr(syscall.TIOCMGET, unsafe.Pointer(&status))
+	return status, err
 }
 
 func (p *Port) setModemLine(tag string, line uint, v bool) error {
@@ -72,17 +570,51 @@ func (p *Port) setModemLine(tag string, line uint, v bool) error {
 	if v {
 		req = syscall.TIOCMBIS
 	}
-	_, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		p.f.Fd(),
-		uintptr(req),
-		uintptr(unsafe.Pointer(&line)),
-	)
-	if errno != 0 {
+	p.lineMu.Lock()
+	err := p.ioctlPtr(uint(req), unsafe.Pointer(&line))
+	p.lineMu.Unlock()
+	if errno, ok := err.(syscall.Errno); ok {
 		p.logMsg(tag, "%t -> error %s [%d]", v, errno.Error(), errno)
 		return errno
+	} else if err != nil {
+		p.logMsg(tag, "%t -> error %s", v, err)
+		return err
 	} else {
-		p.logMsg(tag, "%t", v)
+		p.logControl(tag, "%t", v)
 		return nil
 	}
 }
+
+// control runs fn on the descriptor of the port. Unlike Fd it
+// leaves the file in the runtime poller when it is there.
+func (p *BasePort) control(fn func(fd uintptr) error) error {
+	rc, err := p.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err = rc.Control(func(fd uintptr) { ferr = fn(fd) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+func (p *BasePort) ioctl(req uint, arg uintptr) error {
+	return p.control(func(fd uintptr) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), arg)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+func (p *BasePort) ioctlPtr(req uint, arg unsafe.Pointer) error {
+	return p.control(func(fd uintptr) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
@@ -2,6 +2,10 @@
 
 package serial
 
+// #include <termios.h>
+// #include <unistd.h>
+// #include <poll.h>
+// #include <sys/ioctl.h>
 import "C"
 
 // TODO: Maybe change to using syscall package + ioctl instead of cgo
@@ -11,112 +15,349 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
+var standardBauds = []int{
+	Baud2400, Baud4800, Baud9600, Baud19200, Baud38400, Baud57600, Baud115200,
+}
+
+// BaudConstant returns the termios B* value for baud and whether it is
+// one of the supported standard rates
+func BaudConstant(baud int) (uint32, bool) {
+	switch baud {
+	case 115200:
+		return C.B115200, true
+	case 57600:
+		return C.B57600, true
+	case 38400:
+		return C.B38400, true
+	case 19200:
+		return C.B19200, true
+	case 9600:
+		return C.B9600, true
+	case 4800:
+		return C.B4800, true
+	case 2400:
+		return C.B2400, true
+	}
+	return 0, false
+}
+
 func openPort(c *Config) (p *Port, err error) {
-	f, err := os.OpenFile(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0666)
+	f, err := os.OpenFile(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0666)
 	if err != nil {
 		return
 	}
+	if c.InheritFD {
+		if err = inheritFD(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return newPort(f, c)
+}
 
+// openFD opens the port on a descriptor obtained elsewhere
+func openFD(fd uintptr, c *Config) (*Port, error) {
+	return newPort(os.NewFile(fd, c.Name), c)
+}
+
+// newPort configures the port on f, which it closes on failure
+func newPort(f *os.File, c *Config) (p *Port, err error) {
+	if c.UseDeadlines || c.KeepNonBlock {
+		f.Close()
+		return nil, SerialError{Msg: "UseDeadlines and KeepNonBlock unsupported"}
+	}
 	fd := C.int(f.Fd())
 	if C.isatty(fd) != 1 {
 		f.Close()
 		return nil, errors.New("file is not a tty")
 	}
 
-	var st C.struct_termios
-	_, err = C.tcgetattr(fd, &st)
-	if err != nil {
+	port := &Port{BasePort{f: f, dev: realDevice(f.Name())}}
+	if err = port.applyConfig(c); err != nil {
 		f.Close()
 		return nil, err
 	}
-	var speed C.speed_t
-	switch c.Baud {
-	case 115200:
-		speed = C.B115200
-	case 57600:
-		speed = C.B57600
-	case 38400:
-		speed = C.B38400
-	case 19200:
-		speed = C.B19200
-	case 9600:
-		speed = C.B9600
-	case 4800:
-		speed = C.B4800
-	case 2400:
-		speed = C.B2400
-	default:
+
+	// Fd has made the file blocking already, clear O_NONBLOCK anyway so
+	// that this doesn't depend on it, leaving the other flags alone
+	flags, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0)
+	if e == 0 {
+		_, _, e = syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFL,
+			flags&^syscall.O_NONBLOCK)
+	}
+	if e != 0 {
 		f.Close()
-		return nil, fmt.Errorf("unknown baud rate %v", c.Baud)
+		return nil, fmt.Errorf("clearing O_NONBLOCK: %w", e)
 	}
 
-	_, err = C.cfsetispeed(&st, speed)
+	return port, nil
+}
+
+// applyConfig validates c and sets the termios attributes accordingly
+func (p *Port) applyConfig(c *Config) error {
+	bits, err := c.dataBits()
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
-	_, err = C.cfsetospeed(&st, speed)
+	cstopb, err := termiosStopBits(c, bits)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
+	}
+	if err = checkFlowControl(c); err != nil {
+		return err
+	}
+	var parity C.tcflag_t
+	switch c.Parity {
+	case 0, ParityNone:
+	case ParityOdd:
+		parity = C.PARENB | C.PARODD
+	case ParityEven:
+		parity = C.PARENB
+	default:
+		// no portable mark / space parity
+		return SerialError{Msg: "Unsupported parity", Cod: int(c.Parity)}
+	}
+
+	fd := C.int(p.f.Fd())
+	var st C.struct_termios
+	if _, err = C.tcgetattr(fd, &st); err != nil {
+		return err
+	}
+	if err = setTermiosSpeed(&st, c.Baud); err != nil {
+		return err
 	}
 
 	// Turn off break interrupts, CR->NL, Parity checks, strip, and IXON
 	st.c_iflag &= ^C.tcflag_t(C.BRKINT | C.ICRNL | C.INPCK | C.ISTRIP | C.IXOFF | C.IXON | C.PARMRK)
 
-	// Select local mode, turn off parity, set to 8 bits
-	st.c_cflag &= ^C.tcflag_t(C.CSIZE | C.PARENB | C.CSTOPB)
-	st.c_cflag |= (C.CLOCAL | C.CREAD | C.CS8)
-	if c.StopBits > 1 {
+	if bits == 7 {
+		st.c_iflag |= C.ISTRIP
+	}
+	if c.FlowControl == FlowXONXOFF {
+		st.c_iflag |= C.IXON | C.IXOFF
+	}
+	if c.DetectBreak {
+		st.c_iflag &= ^C.tcflag_t(C.IGNBRK)
+		st.c_iflag |= C.PARMRK
+	}
+	if c.MarkParityErrors {
+		st.c_iflag &= ^C.tcflag_t(C.IGNPAR)
+		st.c_iflag |= C.PARMRK | C.INPCK
+	}
+
+	// Select local mode, parity and character size
+	st.c_cflag &= ^C.tcflag_t(C.CSIZE | C.PARENB | C.PARODD | C.CSTOPB | C.CRTSCTS)
+	st.c_cflag |= (C.CLOCAL | C.CREAD | parity)
+	switch bits {
+	case 5:
+		st.c_cflag |= C.CS5
+	case 6:
+		st.c_cflag |= C.CS6
+	case 7:
+		st.c_cflag |= C.CS7
+	default:
+		st.c_cflag |= C.CS8
+	}
+	if cstopb {
 		st.c_cflag |= C.CSTOPB
 	}
+	if c.DisableReceiver {
+		st.c_cflag &= ^C.tcflag_t(C.CREAD)
+	}
+	if c.FlowControl == FlowRTSCTS {
+		st.c_cflag |= C.CRTSCTS
+	}
 
 	// Select raw mode
 	st.c_lflag &= ^C.tcflag_t(C.ICANON | C.ECHO | C.ECHOE | C.ISIG)
+	if c.Canonical {
+		st.c_lflag |= C.ICANON
+	}
+	if c.Echo {
+		st.c_lflag |= C.ECHO | C.ECHOE
+	}
 	st.c_oflag &= ^C.tcflag_t(C.OPOST)
+	if c.CRLFTranslate {
+		st.c_oflag |= C.OPOST | C.ONLCR
+		st.c_iflag |= C.ICRNL
+	}
 
 	// set blocking / non-blocking read
 	/*
 	*	http://man7.org/linux/man-pages/man3/termios.3.html
 	* - Supports blocking read and read with timeout operations
 	 */
-	vmin, vtime := posixTimeoutValues(c.ReadTimeout)
+	vmin, vtime := posixTimeoutValues(c)
 	st.c_cc[C.VMIN] = C.cc_t(vmin)
 	st.c_cc[C.VTIME] = C.cc_t(vtime)
 
+	if _, err = C.tcsetattr(fd, C.TCSANOW, &st); err != nil {
+		return err
+	}
+	return p.setSpeed(c.Baud)
+}
+
+// cfsetSpeed sets both speeds of st to the B* value for baud
+func cfsetSpeed(st *C.struct_termios, baud int) error {
+	rate, ok := BaudConstant(baud)
+	if !ok {
+		return fmt.Errorf("unknown baud rate %v", baud)
+	}
+	speed := C.speed_t(rate)
+	if _, err := C.cfsetispeed(st, speed); err != nil {
+		return err
+	}
+	_, err := C.cfsetospeed(st, speed)
+	return err
+}
+
+// wakeReader does nothing, the driver doesn't give up a blocked read
+// when the port switches to non-blocking mode like Linux does
+func (p *Port) wakeReader() {}
+
+// HangUp sets the speed to B0 for a moment, which drops DTR and makes
+// a modem hang up, then restores the previous settings
+func (p *Port) HangUp() (err error) {
+	defer func() { err = p.wrapErr("HangUp", err) }()
+	// the temporary settings must not apply to a concurrent read
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	fd := C.int(p.f.Fd())
+	var st C.struct_termios
+	if _, err := C.tcgetattr(fd, &st); err != nil {
+		return err
+	}
+	hup := st
+	C.cfsetospeed(&hup, C.B0)
+	if _, err := C.tcsetattr(fd, C.TCSANOW, &hup); err != nil {
+		p.logMsg("HangUp", "Error %s", err)
+		return err
+	}
+	p.logControl("HangUp", "")
+	time.Sleep(hangUpTime)
 	_, err = C.tcsetattr(fd, C.TCSANOW, &st)
+	return err
+}
+
+// inQueue returns the number of bytes in the input queue of the driver
+func (p *Port) inQueue() (int, error) {
+	var n C.int
+	err := p.ioctlPtr(uint(C.FIONREAD), unsafe.Pointer(&n))
+	return int(n), err
+}
+
+// setOutput suspends or resumes output
+func (p *Port) setOutput(on bool) error {
+	var action C.int = C.TCOOFF
+	if on {
+		action = C.TCOON
+	}
+	_, err := C.tcflow(C.int(p.f.Fd()), action)
 	if err != nil {
-		f.Close()
-		return nil, err
+		p.logMsg("Output", "%t -> error %s", on, err)
+		return err
 	}
+	p.logControl("Output", "%t", on)
+	return nil
+}
 
-	//fmt.Println("Tweaking", name)
-	r1, _, e := syscall.Syscall(
-		syscall.SYS_FCNTL,
-		uintptr(f.Fd()),
-		uintptr(syscall.F_SETFL),
-		uintptr(0),
-	)
-	if e != 0 || r1 != 0 {
-		s := fmt.Sprint("Clearing NONBLOCK syscall error:", e, r1)
-		f.Close()
-		return nil, errors.New(s)
+// drain waits until the written data is transmitted, wl must be held
+func (p *Port) drain() error {
+	_, err := C.tcdrain(C.int(p.f.Fd()))
+	if err != nil {
+		p.logMsg("Drain", "Error %s", err)
 	}
-
-	return &Port{BasePort{f: f}}, nil
+	return err
 }
 
-// Discards data written to the port but not transmitted,
-// or data received but not read
-func (p *Port) Flush() (err error) {
-	_, err = C.tcflush(C.int(p.f.Fd()), C.TCIOFLUSH)
+// flush is FlushWith without the error wrapping
+func (p *Port) flush(flags FlushFlags) (err error) {
+	p.dropPending(flags)
+	queue, ok := tcflushQueue(flags)
+	if !ok {
+		return nil
+	}
+	_, err = C.tcflush(C.int(p.f.Fd()), C.int(queue))
 	if err != nil {
-		p.logMsg("Flush", "Error %d", err)
+		p.logMsg("Flush", "Error %s", err)
 		return err
 	} else {
 		p.logMsg("Flush", "")
 		return nil
 	}
 }
+
+// Select waits until at least one of the ports has data to read and
+// returns the ready ones. A negative timeout waits forever, zero only
+// checks the current state. On timeout the result is empty.
+func Select(ports []*Port, timeout time.Duration) ([]*Port, error) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	fds := make([]C.struct_pollfd, len(ports))
+	for i, p := range ports {
+		p.pollFd(&fds[i])
+	}
+	for _, p := range ports {
+		if p.pendingReady() {
+			// the held back input is there already, see DetectBreak
+			timeout = 0
+			break
+		}
+	}
+	if err := pollFds(fds, timeout); err != nil {
+		return nil, err
+	}
+	var ready []*Port
+	for i, p := range ports {
+		// errors and hangups are reported as ready, Read returns them
+		if fds[i].revents != 0 || p.pendingReady() {
+			ready = append(ready, p)
+		}
+	}
+	return ready, nil
+}
+
+// poll waits until the port has data to read, like Select for one port
+func (p *Port) poll(timeout time.Duration) (bool, error) {
+	var fds [1]C.struct_pollfd
+	p.pollFd(&fds[0])
+	err := pollFds(fds[:], timeout)
+	return err == nil && fds[0].revents != 0, err
+}
+
+// pollFd sets fd to wait for input on the port
+func (p *Port) pollFd(fd *C.struct_pollfd) {
+	fd.fd = C.int(p.f.Fd())
+	fd.events = C.POLLIN
+}
+
+// pollFds waits with poll until one of fds is ready or timeout passed
+func pollFds(fds []C.struct_pollfd, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ms := -1
+		if timeout >= 0 {
+			// a retry after EINTR waits only for the rest of timeout
+			rest := time.Until(deadline)
+			if rest < 0 {
+				rest = 0
+			}
+			ms = int((rest + time.Millisecond - 1) / time.Millisecond)
+		}
+		r, err := C.poll(&fds[0], C.nfds_t(len(fds)), C.int(ms))
+		if r >= 0 {
+			return nil
+		}
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// +build darwin,cgo
+
+package serial
+
+// #include <termios.h>
+// #include <IOKit/serial/ioss.h>
+import "C"
+
+import "unsafe"
+
+// setTermiosSpeed sets the speed in st for the standard rates, any rate
+// is set by setSpeed afterwards
+func setTermiosSpeed(st *C.struct_termios, baud int) error {
+	if _, ok := BaudConstant(baud); ok {
+		return cfsetSpeed(st, baud)
+	}
+	return nil
+}
+
+// setSpeed sets the speed with IOSSIOSPEED, which takes rates like
+// 230400 the B* constants of macOS lack. It has to follow tcsetattr,
+// which resets the speed to that in the termios.
+func (p *Port) setSpeed(baud int) error {
+	if baud <= 0 {
+		return SerialError{Msg: "Invalid baud rate", Cod: baud}
+	}
+	speed := C.speed_t(baud)
+	return p.ioctlPtr(uint(C.IOSSIOSPEED), unsafe.Pointer(&speed))
+}
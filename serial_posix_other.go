@@ -0,0 +1,16 @@
+// +build !windows,!linux,!darwin,cgo
+
+package serial
+
+// #include <termios.h>
+import "C"
+
+// setTermiosSpeed sets the speed in st, which only takes the B* rates
+func setTermiosSpeed(st *C.struct_termios, baud int) error {
+	return cfsetSpeed(st, baud)
+}
+
+// setSpeed completes setting the speed after tcsetattr, nothing to do
+func (p *Port) setSpeed(baud int) error {
+	return nil
+}
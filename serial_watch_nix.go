@@ -0,0 +1,25 @@
+// +build !windows,!linux
+
+package serial
+
+import "path/filepath"
+
+// the serial devices of macOS and the BSDs
+var portGlobs = []string{
+	"/dev/cu.*", "/dev/tty.*", "/dev/cuaU*", "/dev/ttyU*", "/dev/cuau*", "/dev/ttyu*",
+}
+
+// WatchPorts reports serial devices appearing and disappearing until the
+// returned stop function is called, which closes the channel. Devices
+// present at the start are not reported. /dev is polled every second.
+func WatchPorts() (<-chan PortEvent, func(), error) {
+	events, stop := pollPorts(func() []string {
+		var names []string
+		for _, glob := range portGlobs {
+			m, _ := filepath.Glob(glob)
+			names = append(names, m...)
+		}
+		return names
+	}, portPollInterval)
+	return events, stop, nil
+}
@@ -3,23 +3,42 @@
 package serial
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 	"unsafe"
+
+	"golang.org/x/sys/windows/registry"
 )
 
 type Port struct {
 	BasePort
 	fd syscall.Handle
-	rl sync.Mutex
-	wl sync.Mutex
 	ro *syscall.Overlapped
 	wo *syscall.Overlapped
+	eo *syscall.Overlapped
+
+	evMask uint32
+
+	// last output line states, Windows can't read them back
+	dtr bool
+	rts bool
+
+	// overruns seen by ClearCommError, which resets the error flags
+	overruns uint32
 }
 
+// Port can be used wherever an io.ReadWriteCloser is expected
+var _ io.ReadWriteCloser = (*Port)(nil)
+
 type structDCB struct {
 	DCBlength, BaudRate                            uint32
 	flags                                          [4]byte
@@ -29,6 +48,48 @@ type structDCB struct {
 	wReserved1                                     uint16
 }
 
+type structComStat struct {
+	flags    uint32
+	cbInQue  uint32
+	cbOutQue uint32
+}
+
+type structCommProp struct {
+	wPacketLength       uint16
+	wPacketVersion      uint16
+	dwServiceMask       uint32
+	dwReserved1         uint32
+	dwMaxTxQueue        uint32
+	dwMaxRxQueue        uint32
+	dwMaxBaud           uint32
+	dwProvSubType       uint32
+	dwProvCapabilities  uint32
+	dwSettableParams    uint32
+	dwSettableBaud      uint32
+	wSettableData       uint16
+	wSettableStopParity uint16
+	dwCurrentTxQueue    uint32
+	dwCurrentRxQueue    uint32
+	dwProvSpec1         uint32
+	dwProvSpec2         uint32
+	wcProvChar          [1]uint16
+}
+
+// CommProperties describes what a port and its driver support
+type CommProperties struct {
+	MaxBaud       int   // zero if AnyBaud
+	SettableBauds []int // standard rates the driver takes
+	AnyBaud       bool  // the driver takes any rate
+
+	// queue sizes in bytes, zero means no limit or unknown
+	MaxTxQueue, MaxRxQueue         int
+	CurrentTxQueue, CurrentRxQueue int
+
+	DataBits []int
+	StopBits []StopBits
+	Parity   []Parity
+}
+
 type structTimeouts struct {
 	ReadIntervalTimeout         uint32
 	ReadTotalTimeoutMultiplier  uint32
@@ -37,7 +98,190 @@ type structTimeouts struct {
 	WriteTotalTimeoutConstant   uint32
 }
 
-func openPort(c *Config) (p *Port, err error) {
+// the CBR_ rates of the DCB, drivers may take others
+var standardBauds = []int{
+	Baud110, Baud300, Baud600, Baud1200, Baud2400, Baud4800, Baud9600,
+	Baud14400, Baud19200, Baud38400, Baud57600, Baud115200, Baud128000,
+	Baud256000,
+}
+
+// BaudConstant returns the CBR_ value for baud, which is the rate itself,
+// and whether it is a standard rate. The DCB takes other rates as well.
+func BaudConstant(baud int) (uint32, bool) {
+	for _, b := range standardBauds {
+		if b == baud {
+			return uint32(baud), true
+		}
+	}
+	return 0, false
+}
+
+// PortExists reports whether the device, e.g. "COM3", exists, asking
+// QueryDosDevice without opening it
+func PortExists(name string) bool {
+	name = strings.TrimPrefix(name, "\\\\.\\")
+	if loadProcs() != nil || needProc(nQueryDosDevice, "QueryDosDeviceW") != nil {
+		return false
+	}
+	utf16name, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return false
+	}
+	const ERROR_INSUFFICIENT_BUFFER = 122
+	var target [256]uint16
+	r, _, e := syscall.Syscall(nQueryDosDevice, 3, uintptr(unsafe.Pointer(utf16name)),
+		uintptr(unsafe.Pointer(&target[0])), uintptr(len(target)))
+	// a target too long for the buffer still means it exists
+	return r != 0 || e == ERROR_INSUFFICIENT_BUFFER
+}
+
+// DeviceInfo returns the USB ids and strings of the device behind the
+// port, found in the registry by the PortName of the device instance
+func (p *Port) DeviceInfo() (PortInfo, error) {
+	info := PortInfo{Name: strings.ToUpper(strings.TrimPrefix(p.cfg.Name, "\\\\.\\"))}
+	// FTDI drivers have a bus of their own
+	for _, bus := range []string{"USB", "FTDIBUS"} {
+		if findDeviceInfo(&info, "SYSTEM\\CurrentControlSet\\Enum\\"+bus) {
+			return info, nil
+		}
+	}
+	return info, p.wrapErr("DeviceInfo", SerialError{Msg: "No device info"})
+}
+
+// findDeviceInfo looks for the instance of info.Name below the enum key
+func findDeviceInfo(info *PortInfo, enum string) bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, enum, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return false
+	}
+	defer k.Close()
+	devs, _ := k.ReadSubKeyNames(-1)
+	for _, dev := range devs {
+		dk, err := registry.OpenKey(k, dev, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			continue
+		}
+		insts, _ := dk.ReadSubKeyNames(-1)
+		for _, inst := range insts {
+			if !strings.EqualFold(regString(dk, inst+"\\Device Parameters", "PortName"), info.Name) {
+				continue
+			}
+			// e.g. VID_0403&PID_6001 or VID_0403+PID_6001+A12345BA
+			upper := strings.ToUpper(dev)
+			if i := strings.Index(upper, "VID_"); i >= 0 && i+8 <= len(upper) {
+				info.VID = upper[i+4 : i+8]
+			}
+			if i := strings.Index(upper, "PID_"); i >= 0 && i+8 <= len(upper) {
+				info.PID = upper[i+4 : i+8]
+			}
+			if parts := strings.Split(dev, "+"); len(parts) == 3 && len(parts[2]) > 1 {
+				// FTDIBUS appends the interface letter
+				info.SerialNumber = parts[2][:len(parts[2])-1]
+			} else if !strings.Contains(inst, "&") {
+				// an instance id with & is made up by Windows
+				info.SerialNumber = inst
+			}
+			info.Manufacturer = regString(dk, inst, "Mfg")
+			if info.Product = regString(dk, inst, "FriendlyName"); info.Product == "" {
+				info.Product = regString(dk, inst, "DeviceDesc")
+			}
+			dk.Close()
+			return true
+		}
+		dk.Close()
+	}
+	return false
+}
+
+// regString reads a string value, without the "@file.inf,%id%;" prefix
+// of localized strings. It is empty if missing.
+func regString(k registry.Key, path, name string) string {
+	sk, err := registry.OpenKey(k, path, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer sk.Close()
+	s, _, err := sk.GetStringValue(name)
+	if err != nil {
+		return ""
+	}
+	if i := strings.LastIndexByte(s, ';'); i >= 0 && strings.HasPrefix(s, "@") {
+		s = s[i+1:]
+	}
+	return s
+}
+
+// WatchPorts reports COM ports appearing and disappearing until the
+// returned stop function is called, which closes the channel. Ports
+// present at the start are not reported. Windows is polled every second.
+func WatchPorts() (<-chan PortEvent, func(), error) {
+	if err := loadProcs(); err != nil {
+		return nil, nil, err
+	}
+	if err := needProc(nQueryDosDevice, "QueryDosDeviceW"); err != nil {
+		return nil, nil, err
+	}
+	events, stop := pollPorts(func() []string {
+		var names []string
+		for i := 1; i <= 255; i++ {
+			if name := "COM" + strconv.Itoa(i); PortExists(name) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}, portPollInterval)
+	return events, stop, nil
+}
+
+// matchPorts returns the names COM1 to COM255 matching glob, ignoring
+// case. Whether the ports exist is left to opening them.
+func matchPorts(glob string) ([]string, error) {
+	glob = strings.ToUpper(glob)
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := 1; i <= 255; i++ {
+		name := "COM" + strconv.Itoa(i)
+		if ok, _ := filepath.Match(glob, name); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func openPort(c *Config) (*Port, error) {
+	if err := loadProcs(); err != nil {
+		return nil, err
+	}
+	if c.OpenTimeout <= 0 {
+		return openCommPort(c)
+	}
+	type result struct {
+		p   *Port
+		err error
+	}
+	cc := *c
+	done := make(chan result, 1)
+	go func() {
+		p, err := openCommPort(&cc)
+		done <- result{p, err}
+	}()
+	select {
+	case r := <-done:
+		return r.p, r.err
+	case <-time.After(c.OpenTimeout):
+		// close the port if the driver ever finishes opening it
+		go func() {
+			if r := <-done; r.p != nil {
+				r.p.Close()
+			}
+		}()
+		return nil, ErrTimeout
+	}
+}
+
+func openCommPort(c *Config) (p *Port, err error) {
 	name := c.Name
 	if len(name) > 0 && name[0] != '\\' {
 		name = "\\\\.\\" + name
@@ -60,6 +304,20 @@ func openPort(c *Config) (p *Port, err error) {
 	if err != nil {
 		return nil, err
 	}
+	return newPort(h, name, c)
+}
+
+// openFD opens the port on a handle obtained elsewhere, fd is a
+// syscall.Handle. It must have been opened with FILE_FLAG_OVERLAPPED.
+func openFD(fd uintptr, c *Config) (*Port, error) {
+	if err := loadProcs(); err != nil {
+		return nil, err
+	}
+	return newPort(syscall.Handle(fd), c.Name, c)
+}
+
+// newPort configures the port on h, which it closes on failure
+func newPort(h syscall.Handle, name string, c *Config) (p *Port, err error) {
 	f := os.NewFile(uintptr(h), name)
 	defer func() {
 		if err != nil {
@@ -67,13 +325,13 @@ func openPort(c *Config) (p *Port, err error) {
 		}
 	}()
 
-	if err = setCommState(h, c.Baud); err != nil {
+	if err = setCommState(h, c); err != nil {
 		return
 	}
 	if err = setupComm(h, 64, 64); err != nil {
 		return
 	}
-	if err = setCommTimeouts(h, c.ReadTimeout); err != nil {
+	if err = setCommTimeouts(h, c); err != nil {
 		return
 	}
 	if err = setCommMask(h); err != nil {
@@ -88,46 +346,158 @@ func openPort(c *Config) (p *Port, err error) {
 	if err != nil {
 		return
 	}
+	eo, err := newOverlapped()
+	if err != nil {
+		return
+	}
 	port := new(Port)
 	port.f = f
 	port.fd = h
 	port.ro = ro
 	port.wo = wo
+	port.eo = eo
+	port.dtr = !c.NoAssertDSR
 
 	return port, nil
 }
 
-func (p *Port) Write(buf []byte) (n int, err error) {
-	p.wl.Lock()
-	defer p.wl.Unlock()
+// Properties returns what the port and its driver support
+func (p *Port) Properties() (CommProperties, error) {
+	const BAUD_USER = 0x10000000
+	var bauds = []struct {
+		mask uint32
+		baud int
+	}{
+		{0x00000001, 75}, {0x00000002, 110}, {0x00000004, 134}, {0x00000008, 150},
+		{0x00000010, 300}, {0x00000020, 600}, {0x00000040, 1200}, {0x00000080, 1800},
+		{0x00000100, 2400}, {0x00000200, 4800}, {0x00000400, 7200}, {0x00000800, 9600},
+		{0x00001000, 14400}, {0x00002000, 19200}, {0x00004000, 38400}, {0x00040000, 57600},
+		{0x00008000, 56000}, {0x00020000, 115200}, {0x00010000, 128000},
+	}
+
+	if err := needProc(nGetCommProperties, "GetCommProperties"); err != nil {
+		return CommProperties{}, p.wrapErr("Properties", err)
+	}
+	var cp structCommProp
+	cp.wPacketLength = uint16(unsafe.Sizeof(cp))
+	r, _, err := syscall.Syscall(nGetCommProperties, 2, uintptr(p.fd), uintptr(unsafe.Pointer(&cp)), 0)
+	if r == 0 {
+		return CommProperties{}, p.wrapErr("Properties", err)
+	}
+
+	props := CommProperties{
+		AnyBaud:        cp.dwSettableBaud&BAUD_USER != 0 || cp.dwMaxBaud == BAUD_USER,
+		MaxTxQueue:     int(cp.dwMaxTxQueue),
+		MaxRxQueue:     int(cp.dwMaxRxQueue),
+		CurrentTxQueue: int(cp.dwCurrentTxQueue),
+		CurrentRxQueue: int(cp.dwCurrentRxQueue),
+	}
+	for _, b := range bauds {
+		if cp.dwMaxBaud == b.mask {
+			props.MaxBaud = b.baud
+		}
+		if cp.dwSettableBaud&b.mask != 0 {
+			props.SettableBauds = append(props.SettableBauds, b.baud)
+		}
+	}
+	sort.Ints(props.SettableBauds)
+
+	for i, bits := range []int{5, 6, 7, 8} {
+		if cp.wSettableData&(1<<i) != 0 {
+			props.DataBits = append(props.DataBits, bits)
+		}
+	}
+	for i, sb := range []StopBits{StopBits1, StopBits1Half, StopBits2} {
+		if cp.wSettableStopParity&(1<<i) != 0 {
+			props.StopBits = append(props.StopBits, sb)
+		}
+	}
+	for i, par := range []Parity{ParityNone, ParityOdd, ParityEven, ParityMark, ParitySpace} {
+		if cp.wSettableStopParity&(0x100<<i) != 0 {
+			props.Parity = append(props.Parity, par)
+		}
+	}
+	return props, nil
+}
+
+// applyConfig sets the DCB and timeouts for c
+func (p *Port) applyConfig(c *Config) error {
+	if err := setCommState(p.fd, c); err != nil {
+		return err
+	}
+	p.dtr = !c.NoAssertDSR
+	return setCommTimeouts(p.fd, c)
+}
+
+func (p *Port) write(buf []byte) (n int, err error) {
+	// a zero byte WriteFile would still go through the overlapped event
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	defer func() { p.setErr("Write", err) }()
+	data := buf
+	if p.cfg.CRLFTranslate {
+		data = bytes.ReplaceAll(buf, []byte("\n"), []byte("\r\n"))
+	}
 
 	if err = resetEvent(p.wo.HEvent); err != nil {
 		return 0, err
 	}
 	var done uint32
-	err = syscall.WriteFile(p.fd, buf, &done, p.wo)
+	err = syscall.WriteFile(p.fd, data, &done, p.wo)
 	if err != nil && err != syscall.ERROR_IO_PENDING {
-		return int(done), err
+		return crlfWritten(buf, int(done), p.cfg.CRLFTranslate), err
 	}
 
-	n, err = getOverlappedResult(p.fd, p.ro)
-	if err == nil {
-		p.logData('-', buf)
+	n, err = getOverlappedResult(p.fd, p.wo)
+	if n > 0 {
+		p.logData('-', data[:n])
 	}
-	return n, err
+	// a timed out write completes with the count transmitted so far
+	const ERROR_SEM_TIMEOUT = syscall.Errno(121)
+	if (err == nil && n < len(data)) || err == ERROR_SEM_TIMEOUT {
+		err = ErrTimeout
+	}
+	return crlfWritten(buf, n, p.cfg.CRLFTranslate), err
+}
+
+// writev writes the buffers with one overlapped write
+func (p *Port) writev(bufs [][]byte) (int, error) {
+	return p.write(bytes.Join(bufs, nil))
+}
+
+// crlfWritten converts the count of translated bytes written
+// to the count of bytes consumed from buf
+func crlfWritten(buf []byte, n int, translated bool) int {
+	if !translated {
+		return n
+	}
+	i := 0
+	for ; i < len(buf) && n > 0; i++ {
+		if buf[i] == '\n' {
+			if n < 2 {
+				break
+			}
+			n--
+		}
+		n--
+	}
+	return i
 }
 
-func (p *Port) Read(buf []byte) (n int, err error) {
+func (p *Port) read(buf []byte) (n int, err error) {
 	if p == nil || p.f == nil {
 		return 0, fmt.Errorf("invalid port on read %v %v", p, p.f)
 	}
+	defer func() { p.setErr("Read", err) }()
 
-	p.rl.Lock()
-	defer p.rl.Unlock()
-
+	if n = p.takePending(buf); n > 0 {
+		return n, nil
+	}
 	if err = resetEvent(p.ro.HEvent); err != nil {
 		return 0, err
 	}
+	start := time.Now()
 	var done uint32
 	err = syscall.ReadFile(p.fd, buf, &done, p.ro)
 	if err != nil && err != syscall.ERROR_IO_PENDING {
@@ -136,15 +506,24 @@ func (p *Port) Read(buf []byte) (n int, err error) {
 
 	n, err = getOverlappedResult(p.fd, p.ro)
 	if err == nil && n > 0 {
-		p.logData('+', buf)
+		p.logData('+', buf[:n])
+		if p.cfg.CRLFTranslate {
+			for i, b := range buf[:n] {
+				if b == '\r' {
+					buf[i] = '\n'
+				}
+			}
+		}
+	} else if err == nil {
+		err = p.emptyRead(start)
 	}
 	return n, err
 }
 
-// Discards data written to the port but not transmitted,
-// or data received but not read
-func (p *Port) Flush() (err error) {
-	err = purgeComm(p.fd)
+// flush is FlushWith without the error wrapping
+func (p *Port) flush(flags FlushFlags) (err error) {
+	p.dropPending(flags)
+	err = p.withFlushTimeout(func() error { return purgeComm(p.fd, flags) })
 	if err != nil {
 		p.logMsg("Flush", "Error %s", err)
 	} else {
@@ -153,6 +532,50 @@ func (p *Port) Flush() (err error) {
 	return
 }
 
+// setOutput suspends or resumes output as if XOFF / XON was received
+func (p *Port) setOutput(on bool) error {
+	const SETXOFF = 0x0001
+	const SETXON = 0x0002
+	var fn uint = SETXOFF
+	if on {
+		fn = SETXON
+	}
+	return p.setModemLine("Output", fn, on)
+}
+
+// drain waits until the written data is transmitted, wl must be held
+func (p *Port) drain() error {
+	if err := needProc(nFlushFileBuffers, "FlushFileBuffers"); err != nil {
+		return err
+	}
+	err := p.withFlushTimeout(func() error {
+		r, _, err := syscall.Syscall(nFlushFileBuffers, 1, uintptr(p.fd), 0, 0)
+		if r == 0 {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		p.logMsg("Drain", "Error %s", err)
+	}
+	return err
+}
+
+// withFlushTimeout runs fn, giving up after FlushTimeout if set
+func (p *Port) withFlushTimeout(fn func() error) error {
+	if p.cfg.FlushTimeout <= 0 {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(p.cfg.FlushTimeout):
+		return ErrTimeout
+	}
+}
+
 var (
 	nSetCommState,
 	nSetCommTimeouts,
@@ -163,17 +586,54 @@ var (
 	nResetEvent,
 	nPurgeComm,
 	nEscapeCommFunction,
-	nGetCommModemStatus uintptr
-	//nFlushFileBuffers uintptr
+	nGetCommModemStatus,
+	nWaitCommEvent,
+	nClearCommError,
+	nWaitForMultipleObjects,
+	nFlushFileBuffers,
+	nGetCommProperties,
+	nQueryDosDevice uintptr
+
+	procsOnce sync.Once
+	procsErr  error
+	// why a function couldn't be resolved, by name
+	missingProcs = map[string]error{}
 )
 
-func init() {
-	k32, err := syscall.LoadLibrary("kernel32.dll")
-	if err != nil {
-		panic("LoadLibrary " + err.Error())
+// loadProcs resolves the kernel32 functions on first use, so merely
+// importing the package doesn't need them. All ports come from
+// openPort, which calls it. Opening fails only if a function needed
+// for reading and writing is missing, the others fail where used,
+// see needProc, as some embedded images lack them.
+func loadProcs() error {
+	procsOnce.Do(func() {
+		k32, err := syscall.LoadLibrary("kernel32.dll")
+		if err != nil {
+			procsErr = SerialError{Msg: "LoadLibrary kernel32.dll", Err: err}
+			return
+		}
+		defer syscall.FreeLibrary(k32)
+		resolveProcs(k32)
+		for _, name := range []string{"SetCommState", "SetCommTimeouts", "SetCommMask",
+			"SetupComm", "GetOverlappedResult", "CreateEventW", "ResetEvent"} {
+			if err, ok := missingProcs[name]; ok {
+				procsErr = SerialError{Msg: "Missing " + name, Err: err}
+				return
+			}
+		}
+	})
+	return procsErr
+}
+
+// needProc returns an error if the function at addr couldn't be resolved
+func needProc(addr uintptr, name string) error {
+	if addr != 0 {
+		return nil
 	}
-	defer syscall.FreeLibrary(k32)
+	return SerialError{Msg: name + " unsupported on this Windows", Err: missingProcs[name]}
+}
 
+func resolveProcs(k32 syscall.Handle) {
 	nSetCommState = getProcAddr(k32, "SetCommState")
 	nSetCommTimeouts = getProcAddr(k32, "SetCommTimeouts")
 	nSetCommMask = getProcAddr(k32, "SetCommMask")
@@ -182,9 +642,95 @@ func init() {
 	nCreateEvent = getProcAddr(k32, "CreateEventW")
 	nResetEvent = getProcAddr(k32, "ResetEvent")
 	nPurgeComm = getProcAddr(k32, "PurgeComm")
-	//nFlushFileBuffers = getProcAddr(k32, "FlushFileBuffers")
+	nFlushFileBuffers = getProcAddr(k32, "FlushFileBuffers")
+	nGetCommProperties = getProcAddr(k32, "GetCommProperties")
 	nEscapeCommFunction = getProcAddr(k32, "EscapeCommFunction")
 	nGetCommModemStatus = getProcAddr(k32, "GetCommModemStatus")
+	nWaitCommEvent = getProcAddr(k32, "WaitCommEvent")
+	nClearCommError = getProcAddr(k32, "ClearCommError")
+	nWaitForMultipleObjects = getProcAddr(k32, "WaitForMultipleObjects")
+	nQueryDosDevice = getProcAddr(k32, "QueryDosDeviceW")
+}
+
+// Select waits until at least one of the ports has data to read and
+// returns the ready ones. A negative timeout waits forever, zero only
+// checks the current state. On timeout the result is empty.
+// Select must not be called concurrently for the same port.
+func Select(ports []*Port, timeout time.Duration) ([]*Port, error) {
+	const MAXIMUM_WAIT_OBJECTS = 64
+	const INFINITE = 0xFFFFFFFF
+	const WAIT_FAILED = 0xFFFFFFFF
+
+	ready, err := readyPorts(ports)
+	if err != nil || len(ready) > 0 || len(ports) == 0 || timeout == 0 {
+		return ready, err
+	}
+	if err = needProc(nWaitCommEvent, "WaitCommEvent"); err != nil {
+		return nil, err
+	}
+	if err = needProc(nWaitForMultipleObjects, "WaitForMultipleObjects"); err != nil {
+		return nil, err
+	}
+	if len(ports) > MAXIMUM_WAIT_OBJECTS {
+		return nil, SerialError{Msg: "Too many ports to select", Cod: len(ports)}
+	}
+
+	// start an EV_RXCHAR wait on every port
+	events := make([]syscall.Handle, 0, len(ports))
+	defer func() {
+		// changing the mask completes the pending waits
+		for _, p := range ports[:len(events)] {
+			setCommMask(p.fd)
+			getOverlappedResult(p.fd, p.eo)
+		}
+	}()
+	for _, p := range ports {
+		if err = resetEvent(p.eo.HEvent); err != nil {
+			return nil, err
+		}
+		r, _, e := syscall.Syscall(nWaitCommEvent, 3, uintptr(p.fd),
+			uintptr(unsafe.Pointer(&p.evMask)), uintptr(unsafe.Pointer(p.eo)))
+		if r == 0 && e != syscall.ERROR_IO_PENDING {
+			return nil, e
+		}
+		events = append(events, p.eo.HEvent)
+	}
+
+	ms := uint32(INFINITE)
+	if timeout > 0 {
+		t := (timeout + time.Millisecond - 1) / time.Millisecond
+		if t >= INFINITE {
+			t = INFINITE - 1
+		}
+		ms = uint32(t)
+	}
+	r, _, e := syscall.Syscall6(nWaitForMultipleObjects, 4, uintptr(len(events)),
+		uintptr(unsafe.Pointer(&events[0])), 0, uintptr(ms), 0, 0)
+	if r == WAIT_FAILED {
+		return nil, e
+	}
+	return readyPorts(ports)
+}
+
+// poll waits until the port has data to read, like Select for one port
+func (p *Port) poll(timeout time.Duration) (bool, error) {
+	ready, err := Select([]*Port{p}, timeout)
+	return len(ready) > 0, err
+}
+
+// readyPorts returns the ports having bytes in the input queue or held
+// back
+func readyPorts(ports []*Port) (ready []*Port, err error) {
+	for _, p := range ports {
+		var stat structComStat
+		if err = p.commStatus(&stat); err != nil {
+			return nil, err
+		}
+		if stat.cbInQue > 0 || p.pendingReady() {
+			ready = append(ready, p)
+		}
+	}
+	return ready, nil
 }
 
 func (p *Port) SetDtr(v bool) error {
@@ -194,7 +740,46 @@ func (p *Port) SetDtr(v bool) error {
 	if v {
 		line = SETDTR
 	}
-	return p.setModemLine("DTR", line, v)
+	err := p.setModemLine("DTR", line, v)
+	if err == nil {
+		p.dtr = v
+	}
+	return p.wrapErr("SetDtr", err)
+}
+
+// wakeReader does nothing, closing the handle ends a pending read
+func (p *Port) wakeReader() {}
+
+// HangUp drops DTR for a moment to make a modem hang up, then asserts
+// it again if it was asserted. Errors are those of SetDtr.
+func (p *Port) HangUp() error {
+	p.wl.Lock()
+	defer p.wl.Unlock()
+
+	dtr := p.dtr
+	if err := p.SetDtr(false); err != nil {
+		return err
+	}
+	time.Sleep(hangUpTime)
+	if dtr {
+		return p.SetDtr(true)
+	}
+	return nil
+}
+
+// SetModemLines sets DTR and RTS right after each other, Windows can't
+// change both in one call. A nil value leaves the line unchanged.
+// Errors are those of SetDtr and SetRts.
+func (p *Port) SetModemLines(dtr, rts *bool) error {
+	if dtr != nil {
+		if err := p.SetDtr(*dtr); err != nil {
+			return err
+		}
+	}
+	if rts != nil {
+		return p.SetRts(*rts)
+	}
+	return nil
 }
 
 func (p *Port) SetRts(v bool) error {
@@ -204,21 +789,67 @@ func (p *Port) SetRts(v bool) error {
 	if v {
 		line = SETRTS
 	}
-	return p.setModemLine("RTS", line, v)
+	err := p.setModemLine("RTS", line, v)
+	if err == nil {
+		p.rts = v
+	}
+	return p.wrapErr("SetRts", err)
+}
+
+// GetDtr returns the DTR state last set on the port.
+// Windows can't read back the output lines.
+func (p *Port) GetDtr() (bool, error) {
+	return p.dtr, nil
+}
+
+// GetRts returns the RTS state last set on the port.
+// Windows can't read back the output lines.
+func (p *Port) GetRts() (bool, error) {
+	return p.rts, nil
 }
 
 func (p *Port) setModemLine(tag string, line uint, v bool) error {
+	if err := needProc(nEscapeCommFunction, "EscapeCommFunction"); err != nil {
+		p.logMsg(tag, "%t -> %s", v, err)
+		return err
+	}
 	_, _, errno := syscall.Syscall(nEscapeCommFunction, 2, uintptr(p.fd), uintptr(line), 0)
 	if errno != 0 {
 		p.logMsg(tag, "%t -> %s [%d]", v, errno.Error(), errno)
 		return errno
 	} else {
-		p.logMsg(tag, "%t", v)
+		p.logControl(tag, "%t", v)
 		return nil
 	}
 }
 
+// Lines returns the state of all modem lines.
+// DTR and RTS are the states last set on the port.
+func (p *Port) Lines() (Lines, error) {
+	l, err := p.lines()
+	if err != nil {
+		p.logMsg("Lines", "Error %s", err)
+		return Lines{}, p.wrapErr("Lines", err)
+	}
+	p.logControl("Lines", l.String())
+	return l, nil
+}
+
+// lines is Lines without the logging
+func (p *Port) lines() (Lines, error) {
+	cts, dsr, ring, rlsd, err := p.modemStatus()
+	if err != nil {
+		return Lines{}, err
+	}
+	return Lines{CTS: cts, DSR: dsr, RI: ring, DCD: rlsd, DTR: p.dtr, RTS: p.rts}, nil
+}
+
 func (p *Port) GetCommModemStatus() (cts_on, dsr_on, ring_on, rlsd_on bool, err error) {
+	cts_on, dsr_on, ring_on, rlsd_on, err = p.modemStatus()
+	return cts_on, dsr_on, ring_on, rlsd_on, p.wrapErr("GetCommModemStatus", err)
+}
+
+func (p *Port) modemStatus() (cts_on, dsr_on, ring_on, rlsd_on bool, err error) {
 	// The CTS (clear-to-send) signal is on.
 	const MS_CTS_ON = 0x0010
 	// The DSR (data-set-ready) signal is on.
@@ -228,10 +859,13 @@ func (p *Port) GetCommModemStatus() (cts_on, dsr_on, ring_on, rlsd_on bool, err
 	// The RLSD (receive-line-signal-detect) signal is on.
 	const MS_RLSD_ON = 0x0080
 
-	var statusval byte
+	var statusval uint32
 
 	cts_on, dsr_on, ring_on, rlsd_on = false, false, false, false
 
+	if err = needProc(nGetCommModemStatus, "GetCommModemStatus"); err != nil {
+		return
+	}
 	r, _, err := syscall.Syscall(nGetCommModemStatus, 2, uintptr(p.fd), uintptr(unsafe.Pointer(&statusval)), 0)
 	if r == 0 {
 		return cts_on, dsr_on, ring_on, rlsd_on, err
@@ -253,23 +887,73 @@ func (p *Port) GetCommModemStatus() (cts_on, dsr_on, ring_on, rlsd_on bool, err
 	return cts_on, dsr_on, ring_on, rlsd_on, nil
 }
 
+// getProcAddr returns the address of the named function, or zero
+// after recording the error in missingProcs
 func getProcAddr(lib syscall.Handle, name string) uintptr {
 	addr, err := syscall.GetProcAddress(lib, name)
 	if err != nil {
-		panic(name + " " + err.Error())
+		missingProcs[name] = err
+		return 0
 	}
 	return addr
 }
 
-func setCommState(h syscall.Handle, baud int) error {
+func setCommState(h syscall.Handle, c *Config) error {
 	var params structDCB
 	params.DCBlength = uint32(unsafe.Sizeof(params))
 
-	params.flags[0] = 0x01  // fBinary
-	params.flags[0] |= 0x10 // Assert DSR
+	params.flags[0] = 0x01 // fBinary
+	if !c.NoAssertDSR {
+		params.flags[0] |= 0x10 // Assert DSR
+	}
 
-	params.BaudRate = uint32(baud)
-	params.ByteSize = 8
+	params.BaudRate = uint32(c.Baud)
+	const ONESTOPBIT, ONE5STOPBITS, TWOSTOPBITS = 0, 1, 2
+	switch c.StopBits {
+	case 0, StopBits1:
+		params.StopBits = ONESTOPBIT
+	case StopBits1Half:
+		params.StopBits = ONE5STOPBITS
+	case StopBits2:
+		params.StopBits = TWOSTOPBITS
+	default:
+		return SerialError{Msg: "Unsupported stop bits", Cod: int(c.StopBits)}
+	}
+	bits, err := c.dataBits()
+	if err != nil {
+		return err
+	}
+	params.ByteSize = byte(bits)
+	const NOPARITY, ODDPARITY, EVENPARITY, MARKPARITY, SPACEPARITY = 0, 1, 2, 3, 4
+	switch c.Parity {
+	case 0, ParityNone:
+		params.Parity = NOPARITY
+	case ParityOdd:
+		params.Parity = ODDPARITY
+	case ParityEven:
+		params.Parity = EVENPARITY
+	case ParityMark:
+		params.Parity = MARKPARITY
+	case ParitySpace:
+		params.Parity = SPACEPARITY
+	default:
+		return SerialError{Msg: "Unsupported parity", Cod: int(c.Parity)}
+	}
+	if params.Parity != NOPARITY {
+		params.flags[0] |= 0x02 // fParity
+	}
+	switch c.FlowControl {
+	case FlowNone:
+	case FlowRTSCTS:
+		params.flags[0] |= 0x04 // fOutxCtsFlow
+		params.flags[1] |= 0x20 // fRtsControl = RTS_CONTROL_HANDSHAKE
+	case FlowXONXOFF:
+		params.flags[1] |= 0x03 // fOutX, fInX
+		params.XonChar, params.XoffChar = 0x11, 0x13
+		params.XonLim, params.XoffLim = 16, 16
+	default:
+		return SerialError{Msg: "Unsupported flow control", Cod: int(c.FlowControl)}
+	}
 
 	r, _, err := syscall.Syscall(nSetCommState, 2, uintptr(h), uintptr(unsafe.Pointer(&params)), 0)
 	if r == 0 {
@@ -278,11 +962,17 @@ func setCommState(h syscall.Handle, baud int) error {
 	return nil
 }
 
-func setCommTimeouts(h syscall.Handle, readTimeout time.Duration) error {
+func setCommTimeouts(h syscall.Handle, c *Config) error {
 	var timeouts structTimeouts
 	const MAXDWORD = 1<<32 - 1
+	readTimeout := c.ReadTimeout
 
-	if readTimeout > 0 {
+	if c.NonBlocking {
+		// return immediately with the bytes already received
+		timeouts.ReadIntervalTimeout = MAXDWORD
+		timeouts.ReadTotalTimeoutMultiplier = 0
+		timeouts.ReadTotalTimeoutConstant = 0
+	} else if readTimeout > 0 {
 		// non-blocking read
 		timeoutMs := readTimeout.Nanoseconds() / 1e6
 		if timeoutMs < 1 {
@@ -300,6 +990,16 @@ func setCommTimeouts(h syscall.Handle, readTimeout time.Duration) error {
 		timeouts.ReadTotalTimeoutConstant = MAXDWORD - 1
 	}
 
+	if c.WriteTimeout > 0 {
+		timeoutMs := c.WriteTimeout.Nanoseconds() / 1e6
+		if timeoutMs < 1 {
+			timeoutMs = 1
+		} else if timeoutMs > MAXDWORD {
+			timeoutMs = MAXDWORD
+		}
+		timeouts.WriteTotalTimeoutConstant = uint32(timeoutMs)
+	}
+
 	/* From http://msdn.microsoft.com/en-us/library/aa363190(v=VS.85).aspx
 
 		 For blocking I/O see below:
@@ -346,6 +1046,56 @@ func setCommMask(h syscall.Handle) error {
 	return nil
 }
 
+func clearCommError(h syscall.Handle, stat *structComStat) (uint32, error) {
+	var errors uint32
+	r, _, err := syscall.Syscall(nClearCommError, 3, uintptr(h),
+		uintptr(unsafe.Pointer(&errors)), uintptr(unsafe.Pointer(stat)))
+	if r == 0 {
+		return 0, err
+	}
+	return errors, nil
+}
+
+// commStatus reads the queue status, counting the overruns it clears
+func (p *Port) commStatus(stat *structComStat) error {
+	const CE_RXOVER = 0x0001
+	const CE_OVERRUN = 0x0002
+	if err := needProc(nClearCommError, "ClearCommError"); err != nil {
+		return err
+	}
+	errs, err := clearCommError(p.fd, stat)
+	if err != nil {
+		return err
+	}
+	if errs&CE_RXOVER != 0 {
+		p.overruns++
+	}
+	if errs&CE_OVERRUN != 0 {
+		p.overruns++
+	}
+	return nil
+}
+
+// inQueue returns the number of bytes in the input queue of the driver
+func (p *Port) inQueue() (int, error) {
+	var stat structComStat
+	if err := p.commStatus(&stat); err != nil {
+		return 0, err
+	}
+	return int(stat.cbInQue), nil
+}
+
+// InputOverruns returns how often received data was lost because the
+// UART or the input queue was full. Windows only reports that an
+// overrun happened, so this counts the occurrences since opening.
+func (p *Port) InputOverruns() (uint32, error) {
+	var stat structComStat
+	if err := p.commStatus(&stat); err != nil {
+		return 0, p.wrapErr("InputOverruns", err)
+	}
+	return p.overruns, nil
+}
+
 func resetEvent(h syscall.Handle) error {
 	r, _, err := syscall.Syscall(nResetEvent, 1, uintptr(h), 0, 0)
 	if r == 0 {
@@ -354,13 +1104,31 @@ func resetEvent(h syscall.Handle) error {
 	return nil
 }
 
-func purgeComm(h syscall.Handle) error {
+func purgeComm(h syscall.Handle, flags FlushFlags) error {
 	const PURGE_TXABORT = 0x0001
 	const PURGE_RXABORT = 0x0002
 	const PURGE_TXCLEAR = 0x0004
 	const PURGE_RXCLEAR = 0x0008
-	r, _, err := syscall.Syscall(nPurgeComm, 2, uintptr(h),
-		PURGE_TXABORT|PURGE_RXABORT|PURGE_TXCLEAR|PURGE_RXCLEAR, 0)
+	var purge uintptr
+	if flags&FlushRx != 0 {
+		purge |= PURGE_RXCLEAR
+	}
+	if flags&FlushTx != 0 {
+		purge |= PURGE_TXCLEAR
+	}
+	if flags&AbortRx != 0 {
+		purge |= PURGE_RXABORT
+	}
+	if flags&AbortTx != 0 {
+		purge |= PURGE_TXABORT
+	}
+	if purge == 0 {
+		return nil
+	}
+	if err := needProc(nPurgeComm, "PurgeComm"); err != nil {
+		return err
+	}
+	r, _, err := syscall.Syscall(nPurgeComm, 2, uintptr(h), purge, 0)
 	if r == 0 {
 		return err
 	}
@@ -378,7 +1146,7 @@ func newOverlapped() (*syscall.Overlapped, error) {
 }
 
 func getOverlappedResult(h syscall.Handle, overlapped *syscall.Overlapped) (int, error) {
-	var n int
+	var n uint32
 	r, _, err := syscall.Syscall6(
 		nGetOverlappedResult,
 		4,
@@ -390,7 +1158,7 @@ func getOverlappedResult(h syscall.Handle, overlapped *syscall.Overlapped) (int,
 		0,
 	)
 	if r == 0 {
-		return n, err
+		return int(n), err
 	}
-	return n, nil
+	return int(n), nil
 }